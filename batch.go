@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// batcher collects items from the submission workers and hands them to flush
+// in batches of size, or whatever has been collected every interval, so we
+// don't pay a database round trip per item. flush is only ever called from
+// one goroutine
+type batcher[T any] struct {
+	items chan T
+	done  chan struct{}
+	flush func([]T)
+
+	// guards items against workers that outlive the shutdown timeout
+	mu     sync.RWMutex
+	closed bool
+}
+
+// checkBatchFlags rejects -sctBatchSize and -sctFlushInterval values the
+// batchers and -sctsFile can't run with, a zero interval would panic their
+// tickers
+func checkBatchFlags() error {
+	if *sctBatchSize < 1 {
+		return fmt.Errorf("invalid -sctBatchSize %d, must be at least 1", *sctBatchSize)
+	}
+	if *sctFlushInterval <= 0 {
+		return fmt.Errorf("invalid -sctFlushInterval %s, must be positive", *sctFlushInterval)
+	}
+	return nil
+}
+
+func newBatcher[T any](size int, interval time.Duration, flush func([]T)) *batcher[T] {
+	if size < 1 {
+		size = 1
+	}
+	b := &batcher[T]{
+		items: make(chan T, size),
+		done:  make(chan struct{}),
+		flush: flush,
+	}
+	go b.run(size, interval)
+	return b
+}
+
+// add queues item, items added after close are dropped
+func (b *batcher[T]) add(item T) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	b.items <- item
+}
+
+// close flushes any buffered items and waits for the last flush to finish
+func (b *batcher[T]) close() {
+	b.mu.Lock()
+	b.closed = true
+	close(b.items)
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batcher[T]) run(size int, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var batch []T
+	flush := func() {
+		if len(batch) > 0 {
+			b.flush(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case item, ok := <-b.items:
+			if !ok {
+				flush()
+				close(b.done)
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]int
+	flushed := make(chan struct{}, 10)
+	b := newBatcher(3, time.Hour, func(batch []int) {
+		mu.Lock()
+		batches = append(batches, append([]int(nil), batch...))
+		mu.Unlock()
+		flushed <- struct{}{}
+	})
+	for i := 1; i <= 7; i++ {
+		b.add(i)
+	}
+	<-flushed
+	<-flushed
+	// the last partial batch is only flushed on close, and nothing is
+	// queued after that
+	b.close()
+	b.add(8)
+	want := [][]int{{1, 2, 3}, {4, 5, 6}, {7}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("got batches %v, want %v", batches, want)
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	flushed := make(chan []string, 1)
+	b := newBatcher(100, 10*time.Millisecond, func(batch []string) {
+		flushed <- batch
+	})
+	defer b.close()
+	b.add("a")
+	select {
+	case batch := <-flushed:
+		if !reflect.DeepEqual(batch, []string{"a"}) {
+			t.Errorf("got batch %q, want [a]", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial batch wasn't flushed after the interval")
+	}
+}
+
+func TestCheckBatchFlags(t *testing.T) {
+	for _, tc := range []struct {
+		size     int
+		interval time.Duration
+		ok       bool
+	}{
+		{500, 5 * time.Second, true},
+		{1, time.Millisecond, true},
+		{0, 5 * time.Second, false},
+		{500, 0, false},
+		{500, -time.Second, false},
+	} {
+		setValue(t, sctBatchSize, tc.size)
+		setValue(t, sctFlushInterval, tc.interval)
+		if err := checkBatchFlags(); (err == nil) != tc.ok {
+			t.Errorf("checkBatchFlags with -sctBatchSize %d and -sctFlushInterval %s returned %v", tc.size, tc.interval, err)
+		}
+	}
+}
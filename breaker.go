@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// breakerStates are the names used for a circuit breaker's states in the
+// stats and logs
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// maxBreakerCooldown caps how long a breaker stays open after repeatedly
+// failed probes
+const maxBreakerCooldown = 10 * time.Minute
+
+// circuitBreaker pauses submissions to a log after -breakerThreshold
+// consecutive failed attempts. Once the cooldown passes a single probe is let
+// through, if it succeeds the breaker closes, otherwise it opens again for
+// twice as long. A nil breaker never trips
+type circuitBreaker struct {
+	threshold int
+	base      time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	cooldown time.Duration
+	until    time.Time
+	probing  bool
+	trips    int64
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, base: cooldown, cooldown: cooldown, state: breakerClosed}
+}
+
+// allow returns how long to wait before trying again, zero if the attempt can
+// go ahead now
+func (cb *circuitBreaker) allow(now time.Time) time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if now.Before(cb.until) {
+			return cb.until.Sub(now)
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		return 0
+	case breakerHalfOpen:
+		if cb.probing {
+			// wait for the probe to finish
+			return time.Second
+		}
+		cb.probing = true
+		return 0
+	}
+	return 0
+}
+
+// wait blocks until the breaker lets an attempt through or ctx is done
+func (cb *circuitBreaker) wait(ctx context.Context) error {
+	if cb == nil {
+		return nil
+	}
+	for {
+		d := cb.allow(time.Now())
+		if d == 0 {
+			return nil
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// record updates the breaker with the outcome of an attempt and returns true
+// if it just opened
+func (cb *circuitBreaker) record(failed bool, now time.Time) bool {
+	if cb == nil {
+		return false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !failed {
+		cb.state = breakerClosed
+		cb.failures = 0
+		cb.cooldown = cb.base
+		cb.probing = false
+		return false
+	}
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.cooldown *= 2
+		if cb.cooldown > maxBreakerCooldown {
+			cb.cooldown = maxBreakerCooldown
+		}
+	case breakerClosed:
+		cb.failures++
+		if cb.failures < cb.threshold {
+			return false
+		}
+	default:
+		// attempts that started before the breaker opened
+		return false
+	}
+	cb.state = breakerOpen
+	cb.until = now.Add(cb.cooldown)
+	cb.probing = false
+	cb.trips++
+	return true
+}
+
+// status returns the breaker's state and how many times it has opened
+func (cb *circuitBreaker) status() (string, int64) {
+	if cb == nil {
+		return breakerClosed, 0
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state, cb.trips
+}
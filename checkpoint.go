@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// progress tracks the contiguous set of resolved chains, chains complete out
+// of order across workers so lastSubmittedChain alone isn't safe to resume from
+var progress = newWatermark()
+
+// watermark tracks the highest chain ID at or below which every chain handed
+// to the submission pipeline has been resolved, either by being submitted to
+// every log or by being skipped or rejected for good. Chains that failed in a
+// way a later run could fix are held, and the watermark never passes them
+type watermark struct {
+	mu      sync.Mutex
+	pending []int64
+	done    map[int64]bool
+	mark    int64
+	// held is the lowest held chain ID, zero if none are
+	held int64
+}
+
+func newWatermark() *watermark {
+	return &watermark{done: make(map[int64]bool)}
+}
+
+// add registers a chain ID, IDs must be added in ascending order
+func (w *watermark) add(id int64) {
+	w.mu.Lock()
+	w.pending = append(w.pending, id)
+	w.mu.Unlock()
+}
+
+func (w *watermark) resolve(id int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done[id] = true
+	for len(w.pending) > 0 && w.done[w.pending[0]] {
+		w.mark = w.pending[0]
+		delete(w.done, w.mark)
+		w.pending = w.pending[1:]
+	}
+}
+
+// hold keeps the watermark below id, so resuming from it retries the chain.
+// It doesn't resolve id, chains that were added still need resolving
+func (w *watermark) hold(id int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held == 0 || id < w.held {
+		w.held = id
+	}
+}
+
+func (w *watermark) get() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held != 0 && w.held-1 < w.mark {
+		return w.held - 1
+	}
+	return w.mark
+}
+
+// storeMax atomically sets addr to v if v is greater than its current value
+func storeMax(addr *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if v <= old || atomic.CompareAndSwapInt64(addr, old, v) {
+			return
+		}
+	}
+}
+
+// readCheckpoint returns the chain ID stored in path, ok is false if there is
+// no checkpoint yet
+func readCheckpoint(path string) (id int64, ok bool, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	id, err = strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed checkpoint file %q: %s", path, err)
+	}
+	return id, true, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint at path by writing to a
+// temporary file in the same directory and renaming it over the original
+func writeCheckpoint(path string, id int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = fmt.Fprintf(tmp, "%d\n", id)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func checkpoint() {
+	// a dry run didn't submit anything, so the next run has to start from
+	// the same place
+	if *checkpointFile == "" || *dryRun {
+		return
+	}
+	// nothing submitted yet, don't clobber the checkpoint we resumed from
+	id := progress.get()
+	if id == 0 {
+		return
+	}
+	err := writeCheckpoint(*checkpointFile, id)
+	if err != nil {
+		slog.Error("failed to write checkpoint", "err", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestWatermark(t *testing.T) {
+	w := newWatermark()
+	for _, id := range []int64{2, 4, 6, 8, 10} {
+		w.add(id)
+	}
+	check := func(want int64) {
+		t.Helper()
+		if got := w.get(); got != want {
+			t.Errorf("watermark = %d, want %d", got, want)
+		}
+	}
+	// out of order completions don't move it past an unresolved chain
+	w.resolve(4)
+	check(0)
+	w.resolve(2)
+	check(4)
+	// a chain that failed is resolved, but the mark stays below it
+	w.hold(6)
+	w.resolve(6)
+	w.resolve(8)
+	check(5)
+	// and a lower chain that was never added, like one whose certs couldn't
+	// be fetched, pulls it further back
+	w.hold(3)
+	check(2)
+	w.resolve(10)
+	check(2)
+}
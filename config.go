@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// commandLineFlags returns the names of the flags set on the command line, it
+// has to be called before loadConfig since applying the config marks those
+// flags as set as well
+func commandLineFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// loadConfig reads a JSON object whose keys are flag names and applies each
+// value to any flag that isn't in explicit, lists are applied one element at
+// a time for repeatable flags like -logURL
+func loadConfig(path string, explicit map[string]bool) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return fmt.Errorf("malformed config file %q: %s", path, err)
+	}
+	for name, value := range config {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown config field %q", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		values, isList := value.([]interface{})
+		if !isList {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			str, err := configValue(v)
+			if err == nil {
+				err = flag.Set(name, str)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid value for config field %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
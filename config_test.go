@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// restoreFlags resets the flags the config tests touch once the test is done
+func restoreFlags(t *testing.T) {
+	oldURI, oldDry, oldStart, oldWorkers, oldPeriod := *dbURI, *dryRun, *initialChainID, *workers, *statPeriod
+	oldURLs := logURLs
+	t.Cleanup(func() {
+		*dbURI, *dryRun, *initialChainID, *workers, *statPeriod = oldURI, oldDry, oldStart, oldWorkers, oldPeriod
+		logURLs = oldURLs
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	restoreFlags(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"dbURI": "user:pass@tcp(localhost:3306)/dso",
+		"logURL": ["https://a/ct/v1/add-chain", "https://b/ct/v1/add-chain"],
+		"workers": 7,
+		"statsInterval": "5s",
+		"dryRun": true,
+		"initialChainID": 10
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logURLs = nil
+	*workers = 3
+	err = loadConfig(path, map[string]bool{"workers": true})
+	if err != nil {
+		t.Fatalf("loadConfig failed: %s", err)
+	}
+	if *dbURI != "user:pass@tcp(localhost:3306)/dso" {
+		t.Errorf("dbURI = %q", *dbURI)
+	}
+	if want := (stringList{"https://a/ct/v1/add-chain", "https://b/ct/v1/add-chain"}); !reflect.DeepEqual(logURLs, want) {
+		t.Errorf("logURL = %q, want %q", logURLs, want)
+	}
+	if *workers != 3 {
+		t.Errorf("workers = %d, the command line value 3 should win", *workers)
+	}
+	if *statPeriod != 5*time.Second {
+		t.Errorf("statsInterval = %s, want 5s", *statPeriod)
+	}
+	if !*dryRun {
+		t.Error("dryRun wasn't set")
+	}
+	if *initialChainID != 10 {
+		t.Errorf("initialChainID = %d, want 10", *initialChainID)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	restoreFlags(t)
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"unknown field": `{"notAFlag": 1}`,
+		"bad value":     `{"workers": "many"}`,
+		"bad type":      `{"workers": {"n": 1}}`,
+		"malformed":     `{"workers": `,
+		"nested config": `{"config": "other.json"}`,
+	} {
+		path := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(path, nil); err == nil {
+			t.Errorf("%s: loadConfig didn't fail", name)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	restoreFlags(t)
+	logURLs = nil
+	if err := loadConfig("config.example.json", nil); err != nil {
+		t.Fatalf("loadConfig failed on the example config: %s", err)
+	}
+	if len(logURLs) != 2 {
+		t.Errorf("got %d log URLs from the example config, want 2", len(logURLs))
+	}
+}
+
+func TestReadCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if _, ok, err := readCheckpoint(path); err != nil || ok {
+		t.Fatalf("readCheckpoint on a missing file = %t, %v, want false, nil", ok, err)
+	}
+	if err := ioutil.WriteFile(path, []byte("1234\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, ok, err := readCheckpoint(path)
+	if err != nil || !ok || id != 1234 {
+		t.Fatalf("readCheckpoint = %d, %t, %v, want 1234, true, nil", id, ok, err)
+	}
+}
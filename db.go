@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-gorp/gorp"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+func dialectFor(driver string) (gorp.Dialect, error) {
+	switch driver {
+	case "mysql":
+		return gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}, nil
+	case "postgres":
+		return gorp.PostgresDialect{}, nil
+	case "sqlite":
+		return gorp.SqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+}
+
+// openDB opens a pool sized by dbPoolSize and makes sure it can connect
+func openDB(ctx context.Context, dialect gorp.Dialect, uri string) (*gorp.DbMap, error) {
+	innerDB, err := sql.Open(*dbDriver, uri)
+	if err != nil {
+		return nil, err
+	}
+	maxOpen, maxIdle := dbPoolSize()
+	innerDB.SetMaxOpenConns(maxOpen)
+	innerDB.SetMaxIdleConns(maxIdle)
+	innerDB.SetConnMaxLifetime(*dbConnMaxLife)
+	err = innerDB.PingContext(ctx)
+	if err != nil {
+		innerDB.Close()
+		return nil, fmt.Errorf("failed to connect to database: %s", err)
+	}
+	return &gorp.DbMap{Db: innerDB, Dialect: dialect}, nil
+}
+
+// sqliteSchema is the subset of the chains, reports, and certs tables we read,
+// for populating local sqlite databases
+var sqliteSchema = []string{
+	"CREATE TABLE IF NOT EXISTS {chains} (chain_id INTEGER PRIMARY KEY, chain_fp BLOB NOT NULL UNIQUE, valid INTEGER NOT NULL DEFAULT 1, submitted_at TIMESTAMP, log_scts INTEGER)",
+	"CREATE TABLE IF NOT EXISTS {reports} (chain_fp BLOB NOT NULL, cert_fp TEXT NOT NULL, is_end_entity BOOLEAN NOT NULL)",
+	"CREATE INDEX IF NOT EXISTS {reports}_chain_fp ON {reports} (chain_fp)",
+	"CREATE TABLE IF NOT EXISTS {certs} (cert_fp TEXT PRIMARY KEY, raw_cert BLOB NOT NULL)",
+}
+
+// sqliteSCTSchema is the -sctOutputTable, the unique constraint is what
+// makes the SCT inserts idempotent, see onDuplicateSCT
+const sqliteSCTSchema = "CREATE TABLE IF NOT EXISTS %s (chain_fp BLOB NOT NULL, log_url TEXT NOT NULL, sct_version INTEGER NOT NULL, log_id TEXT NOT NULL, timestamp INTEGER NOT NULL, extensions TEXT NOT NULL, signature TEXT NOT NULL, UNIQUE (log_id, chain_fp))"
+
+// createSQLiteSchema creates any of the tables that don't exist yet,
+// including sctTable if it's set
+func createSQLiteSchema(db *gorp.DbMap, sctTable string) error {
+	stmts := sqliteSchema
+	if sctTable != "" {
+		stmts = append(stmts[:len(stmts):len(stmts)], fmt.Sprintf(sqliteSCTSchema, sctTable))
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(tableQuery(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableNames fills in the {chains}, {reports}, and {certs} placeholders in
+// queries, see setTableNames
+var tableNames = strings.NewReplacer("{chains}", "chains", "{reports}", "reports", "{certs}", "certs")
+
+func tableQuery(query string) string {
+	return tableNames.Replace(query)
+}
+
+// setTableNames validates and switches to the given table names, for
+// databases that keep several sets of tables side by side
+func setTableNames(chains, reports, certs string) error {
+	for _, name := range []string{chains, reports, certs} {
+		if err := validIdentifier(name); err != nil {
+			return err
+		}
+	}
+	tableNames = strings.NewReplacer("{chains}", chains, "{reports}", reports, "{certs}", certs)
+	return nil
+}
+
+// identifierPattern matches a plain, optionally schema qualified, table or
+// column name. Identifiers can't be bind variables so they are pasted into
+// queries, anything that would need quoting is refused
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func validIdentifier(name string) error {
+	if !identifierPattern.MatchString(name) {
+		return fmt.Errorf("invalid table or column name %q", name)
+	}
+	return nil
+}
+
+// tableColumns lists the columns of table, which may be schema qualified
+func tableColumns(ctx context.Context, db *gorp.DbMap, table string) (map[string]bool, error) {
+	schema := ""
+	if i := strings.Index(table, "."); i >= 0 {
+		schema, table = table[:i], table[i+1:]
+	}
+	var query string
+	args := []interface{}{table}
+	switch db.Dialect.(type) {
+	case gorp.SqliteDialect:
+		// pragma_table_info takes the schema as its second argument
+		query = "SELECT name FROM pragma_table_info(?, ?)"
+		if schema == "" {
+			schema = "main"
+		}
+		args = append(args, schema)
+	case gorp.PostgresDialect:
+		query = "SELECT column_name FROM information_schema.columns WHERE table_name = ? AND table_schema = COALESCE(NULLIF(?, ''), current_schema())"
+		args = append(args, schema)
+	default:
+		query = "SELECT column_name FROM information_schema.columns WHERE table_name = ? AND table_schema = COALESCE(NULLIF(?, ''), DATABASE())"
+		args = append(args, schema)
+	}
+	var names []string
+	err := withReconnect(ctx, db, func(ctx context.Context) error {
+		_, err := db.WithContext(ctx).Select(&names, rebind(db.Dialect, query), args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]bool, len(names))
+	for _, name := range names {
+		columns[strings.ToLower(name)] = true
+	}
+	return columns, nil
+}
+
+// checkSchema makes sure every table has the columns our queries use, so a
+// mismatched database fails at startup naming what's missing rather than on
+// the first query that touches it
+func checkSchema(ctx context.Context, db *gorp.DbMap, expected map[string][]string) error {
+	var missing []string
+	for table, want := range expected {
+		columns, err := tableColumns(ctx, db, table)
+		if err != nil {
+			return fmt.Errorf("failed to read the columns of %s: %s", table, err)
+		}
+		if len(columns) == 0 {
+			missing = append(missing, table)
+			continue
+		}
+		for _, c := range want {
+			if !columns[strings.ToLower(c)] {
+				missing = append(missing, table+"."+c)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("database is missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// rebind rewrites the ? placeholders our queries are written with into the
+// dialect's bind variables, e.g. $1, $2, ... for Postgres
+func rebind(d gorp.Dialect, query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	b := new(strings.Builder)
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteString(d.BindVar(n))
+		n++
+	}
+	return b.String()
+}
+
+// dbPoolSize returns the open and idle connection limits for the pool. The
+// submission -workers never touch the database, the connections are held by
+// the -dbReaders chain readers, the -certFetchers, and the SCT writer,
+// so unless overridden the pool is sized to let all of them query at once
+// and keep their connections idle between pages rather than reconnecting.
+// Setting -dbMaxOpenConns below that serializes them on the pool instead
+func dbPoolSize() (maxOpen, maxIdle int) {
+	maxOpen = *dbMaxOpenConns
+	if maxOpen <= 0 {
+		maxOpen = *dbReaders + *certFetchers + 1
+	}
+	maxIdle = *dbMaxIdleConns
+	if maxIdle <= 0 || maxIdle > maxOpen {
+		maxIdle = maxOpen
+	}
+	return maxOpen, maxIdle
+}
+
+// isConnError reports whether err means the connection to the database was
+// lost, a server that went away shows up as a bad or closed connection or a
+// network error rather than a MySQL error number
+func isConnError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// queryTimeoutError is returned when a query runs past -dbQueryTimeout
+type queryTimeoutError struct {
+	error
+}
+
+// runQuery runs query with a context that expires after -dbQueryTimeout
+func runQuery(ctx context.Context, query func(context.Context) error) error {
+	if *dbQueryTimeout <= 0 {
+		return query(ctx)
+	}
+	qctx, cancel := context.WithTimeout(ctx, *dbQueryTimeout)
+	defer cancel()
+	err := query(qctx)
+	if err != nil && qctx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return queryTimeoutError{fmt.Errorf("query timed out after %s: %s", *dbQueryTimeout, err)}
+	}
+	return err
+}
+
+// withReconnect runs query and, if it times out or fails because the
+// connection to the database was lost, waits for the pool to answer a ping
+// again and retries it, up to -dbRetries times. query must use the context it
+// is passed so it is aborted on timeout and on shutdown
+func withReconnect(ctx context.Context, db *gorp.DbMap, query func(context.Context) error) error {
+	err := runQuery(ctx, query)
+	for attempt := 0; attempt < *dbRetries && isRetryableDBError(err); attempt++ {
+		slog.Warn("retrying database query", "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoffDelay(attempt)):
+		}
+		if pingErr := db.Db.PingContext(ctx); pingErr != nil {
+			continue
+		}
+		err = runQuery(ctx, query)
+	}
+	return err
+}
+
+func isRetryableDBError(err error) bool {
+	_, timedOut := err.(queryTimeoutError)
+	return timedOut || isConnError(err)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/go-gorp/gorp"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDialectFor(t *testing.T) {
+	for driver, want := range map[string]gorp.Dialect{
+		"mysql":    gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"},
+		"postgres": gorp.PostgresDialect{},
+		"sqlite":   gorp.SqliteDialect{},
+	} {
+		got, err := dialectFor(driver)
+		if err != nil {
+			t.Errorf("dialectFor(%q) failed: %s", driver, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("dialectFor(%q) = %T, want %T", driver, got, want)
+		}
+	}
+	if _, err := dialectFor("oracle"); err == nil {
+		t.Error("dialectFor accepted an unsupported driver")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	for _, tc := range []struct {
+		dialect gorp.Dialect
+		query   string
+		want    string
+	}{
+		{gorp.MySQLDialect{}, selectChains, selectChains},
+		{gorp.SqliteDialect{}, selectChains, selectChains},
+		{gorp.PostgresDialect{}, selectChains, "SELECT chain_fp, chain_id FROM {chains} WHERE valid = 1 AND chain_id > $1 AND chain_id <= $2 ORDER BY chain_id ASC LIMIT $3"},
+		{gorp.PostgresDialect{}, "SELECT cert_fp, raw_cert FROM {certs} WHERE cert_fp IN (?,?,?)", "SELECT cert_fp, raw_cert FROM {certs} WHERE cert_fp IN ($1,$2,$3)"},
+		{gorp.PostgresDialect{}, selectMaxChainID, selectMaxChainID},
+	} {
+		if got := rebind(tc.dialect, tc.query); got != tc.want {
+			t.Errorf("rebind(%T, %q) = %q, want %q", tc.dialect, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestIsConnError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{io.EOF, true},
+		{reset, true},
+		{fmt.Errorf("query failed: %w", reset), true},
+		{&mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}, false},
+		{sql.ErrNoRows, false},
+		{errors.New("syntax error"), false},
+	} {
+		if got := isConnError(tc.err); got != tc.want {
+			t.Errorf("isConnError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+// postgresTestSchema is sqliteSchema for Postgres
+var postgresTestSchema = []string{
+	"CREATE TABLE {chains} (chain_id BIGINT PRIMARY KEY, chain_fp BYTEA NOT NULL UNIQUE, valid INTEGER NOT NULL DEFAULT 1, submitted_at TIMESTAMP, log_scts INTEGER)",
+	"CREATE TABLE {reports} (chain_fp BYTEA NOT NULL, cert_fp TEXT NOT NULL, is_end_entity BOOLEAN NOT NULL)",
+	"CREATE TABLE {certs} (cert_fp TEXT PRIMARY KEY, raw_cert BYTEA NOT NULL)",
+}
+
+// testDB opens a database with empty chains, reports, and certs tables. For
+// sqlite uri is ignored and the database is created in a temporary
+// directory, for Postgres the tables are dropped again once the test is done
+func testDB(t testing.TB, driver, uri string) *gorp.DbMap {
+	t.Helper()
+	setValue(t, dbDriver, driver)
+	if driver == "sqlite" {
+		uri = filepath.Join(t.TempDir(), "chains.db")
+	}
+	dialect, err := dialectFor(driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDB(context.Background(), dialect, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Db.Close() })
+	if driver == "sqlite" {
+		if err := createSQLiteSchema(db, ""); err != nil {
+			t.Fatalf("failed to create schema: %s", err)
+		}
+		return db
+	}
+	drop := func() {
+		for _, table := range []string{"{chains}", "{reports}", "{certs}"} {
+			if _, err := db.Exec(tableQuery("DROP TABLE IF EXISTS " + table)); err != nil {
+				t.Errorf("failed to drop %s: %s", tableQuery(table), err)
+			}
+		}
+	}
+	drop()
+	t.Cleanup(drop)
+	for _, stmt := range postgresTestSchema {
+		if _, err := db.Exec(tableQuery(stmt)); err != nil {
+			t.Fatalf("failed to create schema: %s", err)
+		}
+	}
+	return db
+}
+
+// testReport is a reports row for a test database, a missing cert is
+// reported but left out of the certs table
+type testReport struct {
+	der       []byte
+	endEntity bool
+	missing   bool
+}
+
+// leafFirst reports certs with the first as the end-entity
+func leafFirst(certs [][]byte) []testReport {
+	reports := make([]testReport, len(certs))
+	for i, der := range certs {
+		reports[i] = testReport{der: der, endEntity: i == 0}
+	}
+	return reports
+}
+
+func testCertFP(der []byte) string {
+	fp := sha256.Sum256(der)
+	return hex.EncodeToString(fp[:])
+}
+
+// addTestChain inserts chain id with reports, certs shared with chains added
+// earlier are only inserted once. It returns the chain fingerprint
+func addTestChain(t testing.TB, db *gorp.DbMap, id int64, reports []testReport) []byte {
+	t.Helper()
+	h := sha256.New()
+	for _, r := range reports {
+		h.Write(r.der)
+	}
+	fp := h.Sum(nil)
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+		if _, err := db.Exec(rebind(db.Dialect, tableQuery(query)), args...); err != nil {
+			t.Fatalf("%s: %s", query, err)
+		}
+	}
+	exec("INSERT INTO {chains} (chain_id, chain_fp) VALUES (?, ?)", id, fp)
+	for _, r := range reports {
+		certFP := testCertFP(r.der)
+		exec("INSERT INTO {reports} (chain_fp, cert_fp, is_end_entity) VALUES (?, ?, ?)", fp, certFP, r.endEntity)
+		if r.missing {
+			continue
+		}
+		n, err := db.SelectInt(rebind(db.Dialect, tableQuery("SELECT COUNT(*) FROM {certs} WHERE cert_fp = ?")), certFP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			exec("INSERT INTO {certs} (cert_fp, raw_cert) VALUES (?, ?)", certFP, r.der)
+		}
+	}
+	return fp
+}
+
+// readChains reads every chain in db with getChains and fetches their certs,
+// as the database source does
+func readChains(t *testing.T, db *gorp.DbMap) []chain {
+	t.Helper()
+	setValue(t, initialChainID, 0)
+	ctx := context.Background()
+	chainCh := make(chan []chain, 10)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- getChains(ctx, db, chainCh)
+		close(chainCh)
+	}()
+	var chains []chain
+	for page := range chainCh {
+		fetched, err := fetchCerts(ctx, db, page)
+		if err != nil {
+			t.Fatalf("fetchCerts failed: %s", err)
+		}
+		chains = append(chains, fetched...)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("getChains failed: %s", err)
+	}
+	return chains
+}
+
+// TestPostgresParity reads the same chains from sqlite and from the Postgres
+// database in DSO_TEST_POSTGRES_URI, the tables it uses are created and
+// dropped again so the database should be a scratch one
+func TestPostgresParity(t *testing.T) {
+	uri := os.Getenv("DSO_TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("DSO_TEST_POSTGRES_URI isn't set")
+	}
+	setValue(t, &tableNames, tableNames)
+	if err := setTableNames("dsotoct_test_chains", "dsotoct_test_reports", "dsotoct_test_certs"); err != nil {
+		t.Fatal(err)
+	}
+	first, intermediate := testChain(t)
+	second := issue(t, leafTemplate("second.example.com"), intermediate)
+	fixture := [][][]byte{first, {second.der, first[1], first[2]}}
+	var results [][]chain
+	for _, driver := range []string{"sqlite", "postgres"} {
+		db := testDB(t, driver, uri)
+		for i, certs := range fixture {
+			addTestChain(t, db, int64(i+1), leafFirst(certs))
+		}
+		results = append(results, readChains(t, db))
+	}
+	if len(results[1]) != len(fixture) {
+		t.Fatalf("read %d chains from Postgres, want %d", len(results[1]), len(fixture))
+	}
+	for i, c := range results[1] {
+		if c.ID != int64(i+1) || !reflect.DeepEqual(c.certs, fixture[i]) {
+			t.Errorf("chain %d from Postgres doesn't match the one inserted", i+1)
+		}
+	}
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Error("sqlite and Postgres chains differ")
+	}
+}
+
+func TestSQLiteSource(t *testing.T) {
+	setValue(t, dbReaders, 2)
+	zeroCounters(t, &numChainsRead, &numSkippedNoLeaf, &numResolved)
+	db := testDB(t, "sqlite", "")
+	certs, intermediate := testChain(t)
+	want := map[int64][][]byte{}
+	for _, id := range []int64{1, 2, 5, 9} {
+		leaf := issue(t, leafTemplate("leaf.example.com"), intermediate)
+		want[id] = [][]byte{leaf.der, certs[1], certs[2]}
+		addTestChain(t, db, id, leafFirst(want[id]))
+	}
+	// a chain whose reports have no end-entity is read but skipped
+	addTestChain(t, db, 7, []testReport{{der: certs[1]}, {der: certs[2]}})
+	if _, err := db.Exec(tableQuery("UPDATE {chains} SET valid = 0 WHERE chain_id = 2")); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, 2)
+	chains := readChains(t, db)
+	var ids []int64
+	for _, c := range chains {
+		ids = append(ids, c.ID)
+		if !reflect.DeepEqual(c.certs, want[c.ID]) {
+			t.Errorf("chain %d has the wrong certs", c.ID)
+		}
+		if c.endpoint != addChainPath {
+			t.Errorf("chain %d would be submitted to %s", c.ID, c.endpoint)
+		}
+	}
+	if !reflect.DeepEqual(ids, []int64{1, 5, 9}) {
+		t.Errorf("read chains %d, want [1 5 9]", ids)
+	}
+	if numChainsRead != 4 || numSkippedNoLeaf != 1 {
+		t.Errorf("read %d chains and skipped %d without a leaf, want 4 and 1", numChainsRead, numSkippedNoLeaf)
+	}
+}
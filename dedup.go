@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-gorp/gorp"
+)
+
+// dedup is nil unless -dedupCache or -dedupFromSCTs is set
+var dedup *dedupSet
+
+// dedupSet tracks which chains have already been accepted by which logs,
+// entries are kept in memory and appended to an optional cache file, one
+// "<log URL> <hex chain fingerprint>" pair per line
+type dedupSet struct {
+	mu   sync.RWMutex
+	seen map[string]bool
+	f    *os.File
+	w    *bufio.Writer
+}
+
+func dedupKey(logURL string, fp []byte) string {
+	return logURL + " " + hex.EncodeToString(fp)
+}
+
+func newDedupSet() *dedupSet {
+	return &dedupSet{seen: make(map[string]bool)}
+}
+
+// open loads the existing contents of the cache file at path and opens it
+// for appending new entries
+func (ds *dedupSet) open(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			ds.seen[line] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to read dedup cache %q: %s", path, err)
+	}
+	ds.f = f
+	ds.w = bufio.NewWriter(f)
+	return nil
+}
+
+// loadSCTs adds every chain we've stored an SCT for in table
+func (ds *dedupSet) loadSCTs(ctx context.Context, db *gorp.DbMap, table string) error {
+	var records []sctRecord
+	err := withReconnect(ctx, db, func(ctx context.Context) error {
+		_, err := db.WithContext(ctx).Select(&records, fmt.Sprintf("SELECT chain_fp, log_url FROM %s", table))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		ds.seen[dedupKey(r.LogURL, r.ChainFP)] = true
+	}
+	return nil
+}
+
+func (ds *dedupSet) contains(logURL string, fp []byte) bool {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	return ds.seen[dedupKey(logURL, fp)]
+}
+
+func (ds *dedupSet) add(logURL string, fp []byte) {
+	key := dedupKey(logURL, fp)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.seen[key] {
+		return
+	}
+	ds.seen[key] = true
+	if ds.w != nil {
+		fmt.Fprintln(ds.w, key)
+	}
+}
+
+func (ds *dedupSet) close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.f == nil {
+		return nil
+	}
+	err := ds.w.Flush()
+	if closeErr := ds.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// inFlight holds the chains currently being submitted, so duplicate rows in
+// the source aren't submitted to the same log concurrently. Unlike dedup it
+// only lives for the run and entries are dropped once a submission finishes
+var inFlight = &inFlightSet{keys: make(map[string]bool)}
+
+type inFlightSet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// acquire returns false if the chain is already being submitted to the log
+func (ifs *inFlightSet) acquire(logURL string, fp []byte) bool {
+	key := dedupKey(logURL, fp)
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	if ifs.keys[key] {
+		return false
+	}
+	ifs.keys[key] = true
+	return true
+}
+
+func (ifs *inFlightSet) release(logURL string, fp []byte) {
+	ifs.mu.Lock()
+	defer ifs.mu.Unlock()
+	delete(ifs.keys, dedupKey(logURL, fp))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	getEntriesPath = "/ct/v1/get-entries"
+	// entriesPerRequest is how many entries we ask for at once, logs are free
+	// to return fewer
+	entriesPerRequest = 256
+)
+
+// entriesSource reads chains from another CT log's get-entries, turning it
+// into a mirror. Chain IDs are the entry index plus one, so -initialChainID
+// and checkpoints work the same way they do for the database
+type entriesSource struct {
+	ctx  context.Context
+	c    httpClient
+	base string
+	next int64
+	// end is the last index to read, inclusive
+	end int64
+}
+
+func newEntriesSource(ctx context.Context, c httpClient, logURL string, start, end int64) (*entriesSource, error) {
+	es := &entriesSource{
+		ctx:  ctx,
+		c:    c,
+		base: strings.TrimSuffix(logURL, "/"),
+		next: start,
+		end:  end,
+	}
+	if *initialChainID > es.next {
+		es.next = *initialChainID
+	}
+	if es.end < 0 {
+		size, err := es.treeSize()
+		if err != nil {
+			return nil, err
+		}
+		es.end = size - 1
+	}
+	return es, nil
+}
+
+func (es *entriesSource) get(path string, v interface{}) error {
+	url := es.base + path
+	req, err := newGetRequest(url)
+	if err != nil {
+		return err
+	}
+	resp, err := es.c.Do(req.WithContext(es.ctx))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading response from %s: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d, body: %s", url, resp.StatusCode, body)
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("malformed response from %s: %s", url, err)
+	}
+	return nil
+}
+
+func (es *entriesSource) treeSize() (int64, error) {
+	var sth getSTHResponse
+	if err := es.get(getSTHPath, &sth); err != nil {
+		return 0, err
+	}
+	return int64(sth.TreeSize), nil
+}
+
+type getEntriesResponse struct {
+	Entries []struct {
+		LeafInput []byte `json:"leaf_input"`
+		ExtraData []byte `json:"extra_data"`
+	} `json:"entries"`
+}
+
+func (es *entriesSource) Next() ([]chain, error) {
+	if es.next > es.end || es.ctx.Err() != nil {
+		return nil, io.EOF
+	}
+	last := es.next + entriesPerRequest - 1
+	if last > es.end {
+		last = es.end
+	}
+	var resp getEntriesResponse
+	err := es.get(fmt.Sprintf("%s?start=%d&end=%d", getEntriesPath, es.next, last), &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Entries) == 0 {
+		return nil, fmt.Errorf("%s returned no entries for %d-%d", es.base, es.next, last)
+	}
+	atomic.AddInt64(&numChainsRead, int64(len(resp.Entries)))
+	var chains []chain
+	for _, entry := range resp.Entries {
+		index := es.next
+		es.next++
+		if sampledOut(index + 1) {
+			continue
+		}
+		certs, err := entryChain(entry.LeafInput, entry.ExtraData)
+		if err == nil {
+			certs, err = filterChain(index+1, certs)
+		}
+		if err != nil {
+			logSkip(index+1, fmt.Errorf("entry %d: %s", index, err))
+			continue
+		}
+		c := chain{ID: index + 1, certs: certs}
+		fp := sha256.New()
+		for _, cert := range c.certs {
+			fp.Write(cert)
+		}
+		c.Fingerprint = fp.Sum(nil)
+		c.setEndpoint()
+		chains = append(chains, c)
+	}
+	return chains, nil
+}
+
+// entryChain rebuilds the submitted chain from an entry's MerkleTreeLeaf and
+// extra_data (RFC 6962 sections 3.4 and 4.6). For precertificate entries the
+// leaf input only has the TBSCertificate, so the chain starts with the
+// pre_certificate from extra_data instead
+func entryChain(leafInput, extraData []byte) ([][]byte, error) {
+	// version, leaf_type and the timestamp come before the entry
+	if len(leafInput) < 12 {
+		return nil, errors.New("truncated leaf input")
+	}
+	if leafInput[0] != 0 || leafInput[1] != 0 {
+		return nil, fmt.Errorf("unsupported leaf version %d or type %d", leafInput[0], leafInput[1])
+	}
+	switch binary.BigEndian.Uint16(leafInput[10:12]) {
+	case entryTypeX509:
+		leaf, _, err := readASN1Cert(leafInput[12:])
+		if err != nil {
+			return nil, fmt.Errorf("leaf input: %s", err)
+		}
+		rest, err := readCertChain(extraData)
+		if err != nil {
+			return nil, fmt.Errorf("extra data: %s", err)
+		}
+		return append([][]byte{leaf}, rest...), nil
+	case entryTypePrecert:
+		precert, remaining, err := readASN1Cert(extraData)
+		if err != nil {
+			return nil, fmt.Errorf("extra data: %s", err)
+		}
+		rest, err := readCertChain(remaining)
+		if err != nil {
+			return nil, fmt.Errorf("extra data: %s", err)
+		}
+		return append([][]byte{precert}, rest...), nil
+	default:
+		return nil, fmt.Errorf("unknown entry type %d", binary.BigEndian.Uint16(leafInput[10:12]))
+	}
+}
+
+// readUint24Prefixed reads a TLS opaque vector with a 24 bit length prefix
+func readUint24Prefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 3 {
+		return nil, nil, errors.New("truncated length")
+	}
+	n := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if len(data)-3 < n {
+		return nil, nil, errors.New("truncated data")
+	}
+	return data[3 : 3+n], data[3+n:], nil
+}
+
+func readASN1Cert(data []byte) ([]byte, []byte, error) {
+	cert, rest, err := readUint24Prefixed(data)
+	if err == nil && len(cert) == 0 {
+		err = errors.New("empty certificate")
+	}
+	return cert, rest, err
+}
+
+func readCertChain(data []byte) ([][]byte, error) {
+	list, _, err := readUint24Prefixed(data)
+	if err != nil {
+		return nil, err
+	}
+	var certs [][]byte
+	for len(list) > 0 {
+		var cert []byte
+		cert, list, err = readASN1Cert(list)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
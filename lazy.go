@@ -0,0 +1,129 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-gorp/gorp"
+)
+
+// lazy is nil unless -lazyCerts is set, in which case the sources only read
+// chain IDs and fingerprints and each chain's certs are fetched by the first
+// submission worker to pick it up, so queued chains don't hold their DER
+var lazy *lazyLoader
+
+type lazyLoader struct {
+	db    *gorp.DbMap
+	cache *certCache
+}
+
+// load assembles the chain's certs, once no matter how many logs it's
+// submitted to. It's a no-op unless -lazyCerts is set
+func (pc *pendingChain) load(ctx context.Context) error {
+	if lazy == nil {
+		return nil
+	}
+	pc.once.Do(func() {
+		if pc.certs != nil {
+			return
+		}
+		pc.loadErr = getCerts(ctx, lazy.db, &pc.chain)
+		if pc.loadErr != nil {
+			logSkip(pc.ID, pc.loadErr)
+		}
+	})
+	return pc.loadErr
+}
+
+// certCache is an LRU of raw certs by cert_fp, intermediates are shared by so
+// many chains that most of them are served from here. A nil cache never hits
+type certCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cachedCert struct {
+	fp  string
+	raw []byte
+}
+
+func newCertCache(size int) *certCache {
+	if size <= 0 {
+		return nil
+	}
+	return &certCache{size: size, order: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+func (cc *certCache) get(fp string) ([]byte, bool) {
+	if cc == nil {
+		return nil, false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	e, ok := cc.items[fp]
+	if !ok {
+		return nil, false
+	}
+	cc.order.MoveToFront(e)
+	return e.Value.(*cachedCert).raw, true
+}
+
+func (cc *certCache) add(fp string, raw []byte) {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if e, ok := cc.items[fp]; ok {
+		cc.order.MoveToFront(e)
+		return
+	}
+	cc.items[fp] = cc.order.PushFront(&cachedCert{fp: fp, raw: raw})
+	if cc.order.Len() > cc.size {
+		oldest := cc.order.Back()
+		cc.order.Remove(oldest)
+		delete(cc.items, oldest.Value.(*cachedCert).fp)
+	}
+}
+
+// loadRawCerts returns the raw certs for reports by cert_fp, only querying
+// for the ones that aren't in the cert cache
+func loadRawCerts(ctx context.Context, db *gorp.DbMap, reports []report) (map[string][]byte, error) {
+	var cache *certCache
+	if lazy != nil {
+		cache = lazy.cache
+	}
+	byFP := make(map[string][]byte, len(reports))
+	var missing []interface{}
+	for _, r := range reports {
+		if raw, ok := cache.get(r.CertFP); ok {
+			byFP[r.CertFP] = raw
+			continue
+		}
+		missing = append(missing, r.CertFP)
+	}
+	if len(missing) == 0 {
+		return byFP, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(missing)), ",")
+	var raws []rawCert
+	err := withReconnect(ctx, db, func(ctx context.Context) error {
+		_, err := db.WithContext(ctx).Select(&raws, rebind(db.Dialect, tableQuery(fmt.Sprintf(selectRawCerts, placeholders))), missing...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&numCertsFetched, int64(len(raws)))
+	for _, rc := range raws {
+		byFP[rc.CertFP] = rc.Raw
+		cache.add(rc.CertFP, rc.Raw)
+	}
+	return byFP, nil
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -10,256 +13,1833 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-gorp/gorp"
-	_ "github.com/go-sql-driver/mysql"
+	"golang.org/x/time/rate"
 )
 
 const (
-	maxChains     int    = 1000
-	selectChains  string = "SELECT chain_fp, chain_id FROM chains WHERE valid = 1 ORDER BY chain_id ASC LIMIT ? OFFSET ?"
-	selectReports string = "SELECT DISTINCT(cert_fp), is_end_entity FROM reports WHERE chain_fp = ?"
-	selectRawCert string = "SELECT raw_cert FROM certs WHERE cert_fp = ?"
-	logAddr              = "https://ct.googleapis.com/rocketeer/ct/v1/add-chain"
+	maxChains        int    = 1000
+	selectChains     string = "SELECT chain_fp, chain_id FROM {chains} WHERE valid = 1 AND chain_id > ? AND chain_id <= ? ORDER BY chain_id ASC LIMIT ?"
+	selectChainsByFP string = "SELECT chain_fp, chain_id FROM {chains} WHERE chain_fp IN (%s)"
+	selectChainByFP  string = "SELECT chain_fp, chain_id FROM {chains} WHERE chain_fp = ?"
+	selectChainsByID string = "SELECT chain_fp, chain_id FROM {chains} WHERE chain_id IN (%s)"
+	countChains      string = "SELECT COUNT(*) FROM {chains} WHERE valid = 1 AND chain_id > ? AND chain_id <= ?"
+	selectMaxChainID string = "SELECT COALESCE(MAX(chain_id), 0) FROM {chains}"
+	selectReports    string = "SELECT DISTINCT(cert_fp), is_end_entity FROM {reports} WHERE chain_fp = ?"
+	selectRawCerts   string = "SELECT cert_fp, raw_cert FROM {certs} WHERE cert_fp IN (%s)"
+	logAddr                 = "https://ct.googleapis.com/rocketeer/ct/v1/add-chain"
+
+	addChainPath    = "/ct/v1/add-chain"
+	addPreChainPath = "/ct/v1/add-pre-chain"
+	getRootsPath    = "/ct/v1/get-roots"
+	getSTHPath      = "/ct/v1/get-sth"
+
+	baseBackoff = 100 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+)
+
+// build info, set at build time with -ldflags "-X main.version=... -X
+// main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 var (
 	lastSubmittedChain int64
 	numSubmitted       int64
 	numNewSubmitted    int64
+	numFailed          int64
+	numRejected        int64
+	numBadSCT          int64
+	numUnorderable     int64
+	numQueued          int64
+	numEnqueued        int64
+	numMultiLeaf       int64
+	numDuplicateCerts  int64
+	numExpiredSkipped  int64
+	numOutOfShard      int64
+	numUnparseableLeaf int64
+	numUnknownRoot     int64
+	numSelfSignedLeaf  int64
+	numFiltered        int64
+	numMarshalFailed   int64
+	numExcludedCerts   int64
+	numInFlightDup     int64
+	numOversized       int64
+	numLeafOnly        int64
+	numSampledOut      int64
+	numChainsRead      int64
+	numCertsFetched    int64
+	numNoLeafFirst     int64
+	numDuplicateOK     int64
+	numInvalidDER      int64
+	numNoIntermediate  int64
+	numDanglingCert    int64
+	numDedupSkipped    int64
+	// producerStalledNanos is the total time the feed loop has spent blocked
+	// on a full submissions buffer, a high stall means the workers are the
+	// bottleneck and a low one with an empty buffer means the readers are
+	producerStalledNanos int64
+	// chains skipped by -minNotBefore/-maxNotBefore
+	numOutsideNotBefore int64
+	// totalChains is only known with -countTotal, numResolved counts the
+	// chains read that are done with, whether they were submitted, failed,
+	// or skipped anywhere along the way
+	totalChains int64
+	numResolved int64
+	// why chains were dropped, submitFailed counts per-log submissions that
+	// failed without being rejected
+	numSkippedNoLeaf    int64
+	numSkippedCertFetch int64
+	numSubmitFailed     int64
+
+	dbURI            = flag.String("dbURI", "", "")
+	dbDriver         = flag.String("dbDriver", "mysql", "")
+	createSchema     = flag.Bool("createSchema", false, "")
+	countTotal       = flag.Bool("countTotal", false, "")
+	maxChainBytes    = flag.Int("maxChainBytes", 64*1024, "")
+	resubmitFile     = flag.String("resubmitFile", "", "")
+	leafOnly         = flag.Bool("leafOnly", false, "")
+	sampleEvery      = flag.Int64("sampleEvery", 0, "")
+	chainFP          = flag.String("chainFP", "", "")
+	dbRetries        = flag.Int("dbRetries", 5, "")
+	dbQueryTimeout   = flag.Duration("dbQueryTimeout", 2*time.Minute, "")
+	pemFile          = flag.String("pemFile", "", "")
+	pemDir           = flag.String("pemDir", "", "")
+	dryRun           = flag.Bool("dryRun", false, "")
+	dryRunDir        = flag.String("dryRunDir", "", "")
+	dryRunProbe      = flag.Bool("dryRunProbe", false, "")
+	dryRunProbeRoots = flag.Bool("dryRunProbeRoots", false, "")
+	initialChainID   = flag.Int64("initialChainID", 0, "")
+	workers          = flag.Int("workers", 5, "")
+	dbReaders        = flag.Int("dbReaders", 1, "")
+	certFetchers     = flag.Int("certFetchers", 4, "")
+	statPeriod       = flag.Duration("statsInterval", time.Second*15, "")
+	allowInsecureLog = flag.Bool("allowInsecureLog", false, "")
+	httpTimeout      = flag.Duration("httpTimeout", time.Second*30, "")
+	maxRetries       = flag.Int("maxRetries", 5, "")
+	maxRetryAfter    = flag.Duration("maxRetryAfter", maxBackoff, "")
+	shutdownTimeout  = flag.Duration("shutdownTimeout", time.Second*30, "")
+	freshWindow      = flag.Duration("freshWindow", time.Hour, "")
+	sctOutputTable   = flag.String("sctOutputTable", "", "")
+	sctBatchSize     = flag.Int("sctBatchSize", 500, "")
+	sctFlushInterval = flag.Duration("sctFlushInterval", 5*time.Second, "")
+	metricsAddr      = flag.String("metricsAddr", "", "")
+	pprofAddr        = flag.String("pprofAddr", "", "")
+	dedupCache       = flag.String("dedupCache", "", "")
+	dedupFromSCTs    = flag.Bool("dedupFromSCTs", false, "")
+	rejectLogFile    = flag.String("rejectLog", "", "")
+	maxRate          = flag.Float64("maxRate", 0, "")
+	limit            = flag.Int64("limit", 0, "")
+	onMultiLeaf      = flag.String("onMultiLeaf", "skip", "")
+	noLeafPolicy     = flag.String("noLeafPolicy", "skip", "")
+	gzipRequests     = flag.Bool("gzipRequests", false, "")
+	userAgent        = flag.String("userAgent", "dso-to-ct/"+version, "")
+	skipExpired      = flag.Bool("skipExpired", false, "")
+	prefilterRoots   = flag.Bool("prefilterRoots", false, "")
+	logCAFile        = flag.String("logCAFile", "", "")
+	summaryFile      = flag.String("summaryFile", "", "")
+	healthAddr       = flag.String("healthAddr", "", "")
+	logLevel         = flag.String("logLevel", "info", "")
+	verbose          = flag.Bool("verbose", false, "")
+	logFormat        = flag.String("logFormat", "text", "")
+	csvOutput        = flag.String("csvOutput", "", "")
+	showVersion      = flag.Bool("version", false, "")
+	// defaults to <sctOutputTable>.failed.jsonl
+	sctFallbackFile = flag.String("sctFallbackFile", "", "")
+	// -logAuthToken applies to every log unless overridden by a -logAuth
+	// <logURL>=<token> entry for it
+	logAuthToken  = flag.String("logAuthToken", "", "")
+	logAuthHeader = flag.String("logAuthHeader", "Authorization", "")
+	// the default transport only keeps 2 idle connections per host, which
+	// isn't enough to reuse them across -workers, zero per host means one
+	// per worker
+	httpMaxIdleConns        = flag.Int("httpMaxIdleConns", 100, "")
+	httpMaxIdleConnsPerHost = flag.Int("httpMaxIdleConnsPerHost", 0, "")
+	httpIdleConnTimeout     = flag.Duration("httpIdleConnTimeout", 90*time.Second, "")
+	// each log's workers start spread out over this long
+	workerRampUp = flag.Duration("workerRampUp", 0, "")
+	// -sourceLogURL reads chains from another log's entries [sourceStart,
+	// sourceEnd] instead of the database, a negative end reads up to the
+	// source log's current tree size
+	sourceLogURL = flag.String("sourceLogURL", "", "")
+	sourceStart  = flag.Int64("sourceStart", 0, "")
+	sourceEnd    = flag.Int64("sourceEnd", -1, "")
+	// chains and certs are read from the replica, SCTs are still written to
+	// -dbURI. The replica may lag, so chains marked valid recently can be
+	// missed and ones recently marked invalid can still be submitted
+	replicaDBURI = flag.String("replicaDBURI", "", "")
+	// only chains whose leaf matches every filter that is set are submitted,
+	// note that setting any of them means parsing every leaf
+	filterIssuerCN  = flag.String("filterIssuerCN", "", "")
+	filterSANSuffix = flag.String("filterSANSuffix", "", "")
+	// responses to failed submissions are saved in -responseDir, along with
+	// the request, -saveResponses saves successful ones too
+	responseDir   = flag.String("responseDir", "", "")
+	saveResponses = flag.Bool("saveResponses", false, "")
+	// "-" writes results to stdout, in which case stats move to stderr
+	jsonOutput = flag.String("jsonOutput", "", "")
+	// if -initialChainID is passed on the command line it always wins,
+	// otherwise the starting chain ID is taken from the checkpoint file when
+	// it exists, and only then from -config
+	checkpointFile = flag.String("checkpointFile", "", "")
+	// values from -config only apply to flags not passed on the command line
+	configFile = flag.String("config", "", "")
+	// zero sizes the pool from -dbReaders, see dbPoolSize
+	dbMaxOpenConns = flag.Int("dbMaxOpenConns", 0, "")
+	dbMaxIdleConns = flag.Int("dbMaxIdleConns", 0, "")
+	dbConnMaxLife  = flag.Duration("dbConnMaxLifetime", 5*time.Minute, "")
+	// every buffered chain holds its raw DER, a few KB for a typical chain,
+	// and each log's queue is as deep as this buffer, so the worst case is
+	// roughly (1 + number of logs) * submissionBuffer chains held in memory
+	submissionBuffer = flag.Int("submissionBuffer", 1000, "")
+	// by default only the chains that exist at startup are read, so a run
+	// covers a fixed set even while the table changes, -noSnapshot keeps
+	// reading chains inserted during the run
+	noSnapshot = flag.Bool("noSnapshot", false, "")
+	// after -breakerThreshold consecutive failed attempts submissions to a
+	// log are paused for -breakerCooldown, zero disables the breaker
+	breakerThreshold = flag.Int("breakerThreshold", 0, "")
+	breakerCooldown  = flag.Duration("breakerCooldown", 30*time.Second, "")
+	// with -treatDuplicateAsSuccess an error response with -duplicateStatus
+	// whose body matches -duplicateBodyPattern counts as a submission that
+	// wasn't new, either can be disabled with 0 or "". How a log signals a
+	// chain it has already logged depends on its implementation
+	treatDuplicateAsSuccess = flag.Bool("treatDuplicateAsSuccess", false, "")
+	duplicateStatus         = flag.Int("duplicateStatus", http.StatusConflict, "")
+	duplicateBodyPattern    = flag.String("duplicateBodyPattern", "", "")
+	// chains with certs Go can't parse are submitted as they are and left for
+	// the log to judge, -validateDER skips them instead
+	validateCertDER = flag.Bool("validateDER", false, "")
+	// skips chains that are only a leaf once excluded and duplicate certs are
+	// removed
+	requireIntermediate = flag.Bool("requireIntermediate", false, "")
+	// logs DNS, connect, TLS, and time to first byte for every add-chain
+	// request at debug level, and exports them as histograms
+	traceRequests = flag.Bool("trace", false, "")
+	// -lazyCerts fetches each chain's certs right before it's submitted
+	// rather than when it's read, through an LRU of -certCacheSize certs
+	lazyCerts     = flag.Bool("lazyCerts", false, "")
+	certCacheSize = flag.Int("certCacheSize", 10000, "")
+	// -ordered submits chains to each log strictly in ascending ID order, for
+	// reproducible runs, by using a single worker per log. That gives up
+	// nearly all of the throughput, and submissions to different logs still
+	// interleave however they happen to
+	ordered = flag.Bool("ordered", false, "")
+	// RFC 6962 bodies are JSON, this is only for logs that insist on
+	// something more specific
+	contentType = flag.String("contentType", "application/json", "")
+	// every SCT is appended to -sctsFile as a JSON line, flushed every
+	// -sctFlushInterval
+	sctsFile = flag.String("sctsFile", "", "")
+	// caps the add-chain requests in flight across all logs independently of
+	// -workers, zero is no limit
+	maxInFlight = flag.Int("maxInFlight", 0, "")
+	// -markSubmitted records chains every log accepted in the chains table,
+	// and skips chains already marked, the columns must already exist
+	markSubmitted     = flag.Bool("markSubmitted", false, "")
+	submittedAtColumn = flag.String("submittedAtColumn", "submitted_at", "")
+	logSCTsColumn     = flag.String("logSCTsColumn", "log_scts", "")
+	// the tables chains are read from, for databases holding several sets
+	chainsTable  = flag.String("chainsTable", "chains", "")
+	reportsTable = flag.String("reportsTable", "reports", "")
+	certsTable   = flag.String("certsTable", "certs", "")
+	// the tables are checked for the columns we read at startup, unless
+	// -skipSchemaCheck is set
+	skipSchemaCheck = flag.Bool("skipSchemaCheck", false, "")
+
+	// statsOut is where the stats lines go, stdout unless it's taken by results
+	statsOut io.Writer = os.Stdout
 
-	dbURI      = flag.String("dbURI", "", "")
-	dryRun     = flag.Bool("dryRun", false, "")
-	initOffset = flag.Int("initialChainID", 0, "")
-	workers    = flag.Int("workers", 5, "")
-	statPeriod = flag.Duration("statsInterval", time.Second*15, "")
+	logURLs stringList
+	// when any keys are configured every SCT must verify against one of them
+	logPublicKeys stringList
+	logAuth       stringList
+	// SHA-256 hex fingerprints of intermediates to drop from every chain
+	excludeFingerprints stringList
+	// logs listed in -leafOnlyLog are sent just the leaf, -leafOnly does the
+	// same for every log
+	leafOnlyLogs stringList
+	// <logURL>=<start>,<end>, chains are only sent to a temporally sharded
+	// log if their leaf NotAfter is in [start, end), chains outside every
+	// shard (with no unsharded log configured) are skipped. The bounds are
+	// comma separated so the flag is repeated once per log rather than split
+	logShards entryList
+	// chains whose leaf NotAfter falls outside [minNotAfter, maxNotAfter) are
+	// skipped, to match the temporal shard of the target log
+	minNotAfter timeFlag
+	maxNotAfter timeFlag
+	// and likewise for NotBefore in [minNotBefore, maxNotBefore), to pick out
+	// chains issued in a given window
+	minNotBefore timeFlag
+	maxNotBefore timeFlag
 )
 
+func init() {
+	flag.Var(&logURLs, "logURL", "")
+	flag.Var(&logPublicKeys, "logPublicKey", "")
+	flag.Var(&logAuth, "logAuth", "")
+	flag.Var(&excludeFingerprints, "excludeFingerprints", "")
+	flag.Var(&leafOnlyLogs, "leafOnlyLog", "")
+	flag.Var(&logShards, "logShard", "")
+	flag.Var(&minNotAfter, "minNotAfter", "")
+	flag.Var(&maxNotAfter, "maxNotAfter", "")
+	flag.Var(&minNotBefore, "minNotBefore", "")
+	flag.Var(&maxNotBefore, "maxNotBefore", "")
+}
+
+// stringList collects values from repeated or comma-separated flags
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(v string) error {
+	for _, u := range strings.Split(v, ",") {
+		u = strings.TrimSpace(u)
+		if u != "" {
+			*sl = append(*sl, u)
+		}
+	}
+	return nil
+}
+
+// entryList collects values from repeated flags as is, for values that
+// contain commas themselves
+type entryList []string
+
+func (el *entryList) String() string {
+	return strings.Join(*el, " ")
+}
+
+func (el *entryList) Set(v string) error {
+	if v = strings.TrimSpace(v); v != "" {
+		*el = append(*el, v)
+	}
+	return nil
+}
+
+// timeFlag is an RFC 3339 timestamp, the zero value means unset
+type timeFlag struct {
+	time.Time
+}
+
+func (tf *timeFlag) String() string {
+	if tf.IsZero() {
+		return ""
+	}
+	return tf.Format(time.RFC3339)
+}
+
+func (tf *timeFlag) Set(v string) error {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return err
+	}
+	tf.Time = t
+	return nil
+}
+
+func validateLogURL(logURL string, allowInsecure bool) error {
+	u, err := url.Parse(logURL)
+	if err != nil {
+		return fmt.Errorf("invalid log URL %q: %s", logURL, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid log URL %q: missing host", logURL)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !allowInsecure {
+			return fmt.Errorf("invalid log URL %q: http requires -allowInsecureLog", logURL)
+		}
+	default:
+		return fmt.Errorf("invalid log URL %q: unsupported scheme %q", logURL, u.Scheme)
+	}
+	return nil
+}
+
 type chain struct {
 	Fingerprint []byte   `db:"chain_fp"`
 	ID          int64    `db:"chain_id"`
 	certs       [][]byte `db:"-"`
+	// endpoint is the log path the chain is submitted to, either addChainPath
+	// or addPreChainPath
+	endpoint string `db:"-"`
 }
 
-func getChains(db *gorp.DbMap, chainCh chan []chain) error {
-	offset := *initOffset
-	for {
-		var chains []chain
-		_, err := db.Select(&chains, selectChains, maxChains, offset)
-		if err == sql.ErrNoRows {
-			break
+// setEndpoint picks add-pre-chain for precertificates and add-chain for
+// everything else, including leaves Go can't parse. Without -validateDER
+// filterChain submits those as they are and the log gets the final say
+func (c *chain) setEndpoint() {
+	c.endpoint = addChainPath
+	if cert, err := x509.ParseCertificate(c.certs[0]); err == nil && isPrecert(cert) {
+		c.endpoint = addPreChainPath
+	}
+}
+
+// httpClient is satisfied by *http.Client
+type httpClient interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+type dryClient struct {
+	latency time.Duration
+}
+
+func newDryClient(timeout time.Duration) *dryClient {
+	latency := 500 * time.Millisecond
+	if timeout > 0 && latency > timeout/2 {
+		latency = timeout / 2
+	}
+	return &dryClient{latency}
+}
+
+// dryResponse is a well-formed but unsigned SCT, with an all-zero log ID and
+// an empty ECDSA signature
+const dryResponse = `{"sct_version":0,"id":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","timestamp":%d,"extensions":"","signature":"BAMAAA=="}`
+
+func (dc *dryClient) Do(*http.Request) (*http.Response, error) {
+	time.Sleep(dc.latency)
+	body := fmt.Sprintf(dryResponse, time.Now().UnixMilli())
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+// retryableError marks a submission failure that may succeed if attempted
+// again, after is how long the log asked us to wait first (if it said)
+type retryableError struct {
+	error
+	after time.Duration
+}
+
+// rejectedError is a 4xx response, the log will never accept the chain as is
+type rejectedError struct {
+	error
+	status int
+	body   []byte
+}
+
+func isRetryable(err error) bool {
+	_, ok := err.(retryableError)
+	return ok
+}
+
+// isTransient reports whether a request error is worth retrying, timeouts and
+// dropped or refused connections are, while TLS verification failures and
+// malformed URLs will fail the same way every time
+func isTransient(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Op == "parse" {
+		return false
+	}
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// parseRetryAfter handles both the delay-seconds and HTTP-date forms of the
+// Retry-After header, returning zero if it is missing or malformed
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
 		}
-		if err != nil {
-			return err
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(header)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
+
+type ctLog struct {
+	url string
+	// base is url without any add-chain suffix, so -logURL can be given either
+	// as the log's base URL or its add-chain endpoint
+	base string
+	// limiter is shared by all of the log's workers, nil if -maxRate is 0
+	limiter *rate.Limiter
+
+	numSubmitted    int64
+	numNewSubmitted int64
+	numFailed       int64
+	numRejected     int64
+	numSkipped      int64
+	// noGzip is set once the log refuses a compressed request
+	noGzip int32
+	// warnedMediaType is set once a 415 or 406 from the log has been logged
+	warnedMediaType int32
+	// sthTimestamp is the timestamp of the log's latest STH, zero if it
+	// couldn't be fetched
+	sthTimestamp int64
+	// authToken is sent in -logAuthHeader on every request, it must never be
+	// logged
+	authToken string
+	// leafOnly logs build chains themselves and are only sent the leaf
+	leafOnly bool
+	// breaker is nil unless -breakerThreshold is set
+	breaker *circuitBreaker
+	// shard is nil unless the log is given a -logShard window
+	shard *shardWindow
+}
+
+// authorize adds the log's auth token to req, as a bearer token when the
+// header is Authorization
+func (l *ctLog) authorize(req *http.Request) {
+	if l.authToken == "" {
+		return
+	}
+	value := l.authToken
+	if http.CanonicalHeaderKey(*logAuthHeader) == "Authorization" {
+		value = "Bearer " + value
+	}
+	req.Header.Set(*logAuthHeader, value)
+}
+
+// pendingChain is a chain being submitted to every configured log, it is only
+// considered submitted once all of them have accepted it
+type pendingChain struct {
+	chain
+	remaining   int32
+	isNew       int32
+	anyFailed   int32
+	anyRejected int32
+	// scts counts the SCTs the logs returned for the chain
+	scts int32
+	// dropped is set if the chain's certs couldn't be loaded, see load
+	dropped int32
+	once    sync.Once
+	loadErr error
+}
+
+func (pc *pendingChain) accepted(isNew bool) {
+	if isNew {
+		atomic.StoreInt32(&pc.isNew, 1)
+	}
+	pc.finish()
+}
+
+func (pc *pendingChain) failed(rejected bool) {
+	if rejected {
+		atomic.StoreInt32(&pc.anyRejected, 1)
+	}
+	atomic.StoreInt32(&pc.anyFailed, 1)
+	pc.finish()
+}
+
+// drop resolves the chain without counting it either way, like the chains
+// sources skip
+func (pc *pendingChain) drop() {
+	atomic.StoreInt32(&pc.dropped, 1)
+	pc.finish()
+}
+
+func (pc *pendingChain) finish() {
+	if atomic.AddInt32(&pc.remaining, -1) != 0 {
+		return
+	}
+	switch {
+	case atomic.LoadInt32(&pc.dropped) == 1:
+		// why was counted, and the chain counted as resolved, by logSkip
+		// when it was skipped
+		if _, ok := pc.loadErr.(fetchError); ok {
+			progress.hold(pc.ID)
 		}
-		chainCh <- chains
-		if len(chains) < maxChains {
-			break
+	case atomic.LoadInt32(&pc.anyFailed) == 0:
+		if atomic.LoadInt32(&pc.isNew) == 1 {
+			atomic.AddInt64(&numNewSubmitted, 1)
 		}
-		offset += len(chains)
+		storeMax(&lastSubmittedChain, pc.ID)
+		marker.add(pc.ID, atomic.LoadInt32(&pc.scts))
+		atomic.AddInt64(&numSubmitted, 1)
+	case atomic.LoadInt32(&pc.anyRejected) == 1:
+		atomic.AddInt64(&numRejected, 1)
+	default:
+		// the next run resumes from before the chain, a rejection would just
+		// happen again so those don't hold it
+		atomic.AddInt64(&numFailed, 1)
+		progress.hold(pc.ID)
 	}
-	return nil
+	if atomic.LoadInt32(&pc.dropped) == 0 {
+		atomic.AddInt64(&numResolved, 1)
+	}
+	atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+	progress.resolve(pc.ID)
 }
 
-type report struct {
-	CertFP    string `db:"cert_fp"`
-	EndEntity bool   `db:"is_end_entity"`
+// ctResponse is the add-chain response from RFC 6962 section 4.1
+type ctResponse struct {
+	SCTVersion int    `json:"sct_version"`
+	ID         string `json:"id"`
+	Timestamp  int64  `json:"timestamp"`
+	Extensions string `json:"extensions"`
+	Signature  string `json:"signature"`
 }
 
-func getCerts(db *gorp.DbMap, partialChain *chain) error {
-	var reports []report
-	_, err := db.Select(&reports, selectReports, partialChain.Fingerprint)
+// latestSCT holds a *sctSummary for the most recent SCT any log returned
+var latestSCT atomic.Value
+
+type sctSummary struct {
+	logURL    string
+	logID     []byte
+	timestamp int64
+}
+
+func (ss *sctSummary) String() string {
+	id := ss.logID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return fmt.Sprintf("[log: %s, log ID: %x..., timestamp: %s]", ss.logURL, id, time.UnixMilli(ss.timestamp).UTC().Format(time.RFC3339))
+}
+
+// validateSCT checks that a 2xx response actually has the mandatory add-chain
+// response fields, so an error page from a proxy or an empty JSON object isn't
+// counted as a submission. sct_version is zero for v1 so only its presence can
+// be checked
+func validateSCT(body []byte, ctr ctResponse) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
 	if err != nil {
 		return err
 	}
-	var leaf []byte
-	var others [][]byte
-	for _, r := range reports {
-		var raw []byte
-		err := db.SelectOne(&raw, selectRawCert, r.CertFP)
+	switch {
+	case fields["sct_version"] == nil:
+		return errors.New("missing sct_version")
+	case ctr.ID == "":
+		return errors.New("missing id")
+	case ctr.Timestamp == 0:
+		return errors.New("missing timestamp")
+	case ctr.Signature == "":
+		return errors.New("missing signature")
+	}
+	return nil
+}
+
+// isFresh reports whether the SCT timestamp ts, in milliseconds since the
+// epoch per RFC 6962, falls within window of now
+func isFresh(ts int64, now time.Time, window time.Duration) bool {
+	return ts > now.Add(-window).UnixMilli()
+}
+
+func submit(ctx context.Context, c httpClient, log *ctLog, submission *pendingChain) (*ctResponse, error) {
+	url := log.base + submission.endpoint
+	started := time.Now()
+	defer func() {
+		submitLatency.WithLabelValues(log.url).Observe(time.Since(started).Seconds())
+	}()
+	certs := submission.certs
+	if log.leafOnly {
+		certs = certs[:1]
+	}
+	buf := bodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	err := certsToSub(buf, certs)
+	if err != nil {
+		bodyPool.Put(buf)
+		atomic.AddInt64(&numMarshalFailed, 1)
+		return nil, fmt.Errorf("chain %d: failed to marshal submission: %s", submission.ID, err)
+	}
+	// the transport may read the request body after the round trip returns,
+	// to follow a redirect or retry on a new connection, so the request gets
+	// its own copy and the buffer goes straight back to the pool
+	reqBody := append([]byte(nil), buf.Bytes()...)
+	bodyPool.Put(buf)
+	if *dryRunDir != "" {
+		err = ioutil.WriteFile(filepath.Join(*dryRunDir, fmt.Sprintf("%d.json", submission.ID)), reqBody, 0644)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("chain %d: %s", submission.ID, err)
 		}
-		if r.EndEntity {
-			leaf = raw
-		} else {
-			others = append(others, raw)
+	}
+	if err := requestSlots.acquire(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := post(c, log, url, reqBody)
+	if err != nil {
+		requestSlots.release()
+		transient := isTransient(err)
+		err = fmt.Errorf("chain %d: %s", submission.ID, err)
+		if transient {
+			return nil, retryableError{error: err}
 		}
+		return nil, err
 	}
-	if leaf == nil {
-		return errors.New("chain without end-entity")
+	countStatus(log, resp.StatusCode)
+	// always consume the whole body so the connection can be reused
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	requestSlots.release()
+	if err != nil {
+		return nil, retryableError{error: fmt.Errorf("chain %d: reading response from %s (status %d): %s", submission.ID, url, resp.StatusCode, err)}
 	}
-	partialChain.certs = append([][]byte{leaf}, others...)
-	return nil
+	accepted := false
+	if *responseDir != "" {
+		defer func() {
+			if !accepted || *saveResponses {
+				saveResponse(*responseDir, submission.chain, log, reqBody, resp, body)
+			}
+		}()
+	}
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) && *treatDuplicateAsSuccess && isDuplicate(resp.StatusCode, body) {
+		atomic.AddInt64(&numDuplicateOK, 1)
+		atomic.AddInt64(&log.numSubmitted, 1)
+		if dedup != nil && !*dryRun {
+			dedup.add(log.url, submission.Fingerprint)
+		}
+		accepted = true
+		submission.accepted(false)
+		// there's no SCT to return
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("chain %d: %s returned status %d, body: %s", submission.ID, url, resp.StatusCode, body)
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			return nil, retryableError{error: err, after: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			return nil, rejectedError{error: err, status: resp.StatusCode, body: body}
+		case resp.StatusCode >= 500:
+			return nil, retryableError{error: err}
+		}
+		return nil, err
+	}
+	var ctr ctResponse
+	err = json.Unmarshal(body, &ctr)
+	if err == nil {
+		err = validateSCT(body, ctr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chain %d: malformed response from %s (status %d): %s", submission.ID, url, resp.StatusCode, err)
+	}
+	if logKeys != nil {
+		err = logKeys.verify(submission.chain, ctr)
+		if err == errUnverifiable {
+			slog.Warn("skipping SCT verification", "chain", submission.ID, "log", log.url, "err", err)
+		} else if err != nil {
+			atomic.AddInt64(&numBadSCT, 1)
+			return nil, fmt.Errorf("chain %d: bad SCT from %s: %s", submission.ID, url, err)
+		}
+	}
+	logID, _ := base64.StdEncoding.DecodeString(ctr.ID)
+	latestSCT.Store(&sctSummary{logURL: log.url, logID: logID, timestamp: ctr.Timestamp})
+	isNew := isFresh(ctr.Timestamp, log.now(), *freshWindow)
+	if isNew {
+		atomic.AddInt64(&log.numNewSubmitted, 1)
+	}
+	atomic.AddInt64(&log.numSubmitted, 1)
+	atomic.AddInt32(&submission.scts, 1)
+	if log.leafOnly {
+		atomic.AddInt64(&numLeafOnly, 1)
+	}
+	// the fake SCTs from a dry run are never persisted
+	if !*dryRun {
+		sctLog.write(submission.chain, log.url, &ctr)
+	}
+	if sctStore != nil && !*dryRun {
+		sctStore.add(&sctRecord{
+			ChainFP:    submission.Fingerprint,
+			LogURL:     log.url,
+			SCTVersion: ctr.SCTVersion,
+			LogID:      ctr.ID,
+			Timestamp:  ctr.Timestamp,
+			Extensions: ctr.Extensions,
+			Signature:  ctr.Signature,
+		})
+	}
+	if dedup != nil && !*dryRun {
+		dedup.add(log.url, submission.Fingerprint)
+	}
+	accepted = true
+	submission.accepted(isNew)
+	return &ctr, nil
 }
 
-type httpClient interface {
-	Post(string, string, io.Reader) (*http.Response, error)
-}
+// semaphore is a counting semaphore, a nil semaphore never blocks
+type semaphore chan struct{}
 
-type dryClient struct{}
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
 
-func (dc *dryClient) Post(string, string, io.Reader) (*http.Response, error) {
-	time.Sleep(500 * time.Millisecond)
-	return &http.Response{StatusCode: http.StatusOK}, nil
+// acquire waits for a slot, giving up with ctx's error once it's done
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-type ctResponse struct {
-	Timestamp int64
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
 }
 
-func submit(c httpClient, submission chain) error {
-	resp, err := c.Post(logAddr, "encoding/json", bytes.NewBuffer(certsToSub(submission.certs)))
-	if err != nil {
-		return err
+// requestSlots limits the add-chain requests in flight across every log to
+// -maxInFlight
+var requestSlots semaphore
+
+// duplicateBody is compiled from -duplicateBodyPattern, nil if it's unset
+var duplicateBody *regexp.Regexp
+
+// isDuplicate reports whether an error response is the log's signal for a
+// chain it has already logged
+func isDuplicate(status int, body []byte) bool {
+	if *duplicateStatus != 0 && status != *duplicateStatus {
+		return false
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		var bodyStr string
-		body, err := ioutil.ReadAll(resp.Body)
+	return duplicateBody == nil || duplicateBody.Match(body)
+}
+
+// post sends body to url, gzip-compressed if -gzipRequests is set, falling
+// back to (and sticking with) uncompressed bodies once the log responds to a
+// compressed one with a 415
+func post(c httpClient, log *ctLog, url string, body []byte) (*http.Response, error) {
+	if *gzipRequests && atomic.LoadInt32(&log.noGzip) == 0 {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		req, err := newSubmitRequest(url, compressed.Bytes())
 		if err != nil {
-			bodyStr = err.Error()
+			return nil, err
+		}
+		log.authorize(req)
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := sendRequest(c, log, req)
+		if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+			return resp, err
 		}
-		bodyStr = string(body)
-		return fmt.Errorf("non-200 status code, body: %s", bodyStr)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		atomic.StoreInt32(&log.noGzip, 1)
 	}
-	b, err := ioutil.ReadAll(resp.Body)
+	req, err := newSubmitRequest(url, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var ctr ctResponse
-	err = json.Unmarshal(b, &ctr)
+	log.authorize(req)
+	resp, err := sendRequest(c, log, req)
+	if err == nil && (resp.StatusCode == http.StatusUnsupportedMediaType || resp.StatusCode == http.StatusNotAcceptable) && atomic.CompareAndSwapInt32(&log.warnedMediaType, 0, 1) {
+		slog.Error(
+			"log refused the request's media types, check -contentType",
+			"log", log.url,
+			"status", resp.StatusCode,
+			"content_type", req.Header.Get("Content-Type"),
+			"accept", req.Header.Get("Accept"),
+			"response_content_type", resp.Header.Get("Content-Type"),
+		)
+	}
+	return resp, err
+}
+
+func newSubmitRequest(url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if ctr.Timestamp > int64(time.Now().UTC().Add(-time.Hour).UnixNano()/1000) {
-		atomic.AddInt64(&numNewSubmitted, 1)
+	req.Header.Set("Content-Type", *contentType)
+	req.Header.Set("Accept", "application/json")
+	if *userAgent != "" {
+		req.Header.Set("User-Agent", *userAgent)
 	}
-	atomic.StoreInt64(&lastSubmittedChain, submission.ID)
-	atomic.AddInt64(&numSubmitted, 1)
-	return nil
+	return req, nil
 }
 
-func submitChains(submissions chan chain) error {
-	var c httpClient
-	if *dryRun {
-		c = &dryClient{}
-	} else {
-		c = new(http.Client)
+func newGetRequest(url string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if *userAgent != "" {
+		req.Header.Set("User-Agent", *userAgent)
+	}
+	return req, nil
+}
+
+// backoffDelay returns the delay before retry attempt+1, doubling from
+// baseBackoff up to maxBackoff with jitter over the upper half of the window
+func backoffDelay(attempt int) time.Duration {
+	d := baseBackoff << uint(attempt)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
 	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func submitWithRetry(ctx context.Context, c httpClient, log *ctLog, submission *pendingChain) (*ctResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if err := paused.wait(ctx); err != nil {
+			return nil, err
+		}
+		if err := log.breaker.wait(ctx); err != nil {
+			return nil, err
+		}
+		if log.limiter != nil {
+			if err := log.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		ctr, err := submit(ctx, c, log, submission)
+		if log.breaker.record(isRetryable(err), time.Now()) {
+			slog.Warn("log keeps failing, pausing submissions", "log", log.url, "err", err)
+		}
+		if err == nil || !isRetryable(err) || attempt >= *maxRetries {
+			return ctr, err
+		}
+		delay := err.(retryableError).after
+		if delay > *maxRetryAfter {
+			slog.Warn("clamping Retry-After from log", "log", log.url, "retryAfter", delay, "max", *maxRetryAfter)
+			delay = *maxRetryAfter
+		}
+		if delay == 0 {
+			delay = backoffDelay(attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (l *ctLog) run(ctx context.Context, c httpClient, queue chan *pendingChain) {
 	wg := new(sync.WaitGroup)
 	for i := 0; i < *workers; i++ {
 		wg.Add(1)
-		go func() {
-			for submission := range submissions {
-				err := submit(c, submission)
-				if err != nil {
-					continue
+		go func(i int) {
+			if delay := rampUpDelay(i, *workers, *workerRampUp); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+			}
+			for submission := range queue {
+				if ctx.Err() != nil {
+					break
 				}
-				atomic.StoreInt64(&lastSubmittedChain, submission.ID)
+				l.handle(ctx, c, submission)
 			}
 			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+// rampUpDelay staggers worker start times evenly across rampUp, with each
+// worker starting at a random point in its slot. Dry runs start everything
+// at once
+func rampUpDelay(worker, workers int, rampUp time.Duration) time.Duration {
+	if rampUp <= 0 || workers < 2 || *dryRun {
+		return 0
+	}
+	slot := rampUp / time.Duration(workers)
+	return time.Duration(worker)*slot + time.Duration(rand.Int63n(int64(slot)+1))
+}
+
+func (l *ctLog) handle(ctx context.Context, c httpClient, submission *pendingChain) {
+	if submission.load(ctx) != nil {
+		submission.drop()
+		return
+	}
+	if dedup != nil && dedup.contains(l.url, submission.Fingerprint) {
+		atomic.AddInt64(&numDedupSkipped, 1)
+		atomic.AddInt64(&l.numSkipped, 1)
+		submission.accepted(false)
+		writeResult(submission.chain, l.url, nil, "skipped")
+		slog.Debug("skipping chain already submitted", "chain_id", submission.ID, "log", l.url)
+		return
+	}
+	if !inFlight.acquire(l.url, submission.Fingerprint) {
+		atomic.AddInt64(&numInFlightDup, 1)
+		atomic.AddInt64(&l.numSkipped, 1)
+		submission.accepted(false)
+		writeResult(submission.chain, l.url, nil, "skipped")
+		slog.Debug("skipping chain already being submitted", "chain_id", submission.ID, "log", l.url)
+		return
+	}
+	defer inFlight.release(l.url, submission.Fingerprint)
+	ctr, err := submitWithRetry(ctx, c, l, submission)
+	if re, ok := err.(rejectedError); ok {
+		slog.Warn("chain rejected", "chain_id", submission.ID, "log", l.url, "status", re.status, "err", err)
+		atomic.AddInt64(&l.numRejected, 1)
+		if rejects != nil {
+			rejects.record(submission.chain, l.url, re)
+		}
+		submission.failed(true)
+		writeResult(submission.chain, l.url, nil, "rejected")
+	} else if err != nil {
+		slog.Warn("submission failed", "chain_id", submission.ID, "log", l.url, "err", err)
+		atomic.AddInt64(&numSubmitFailed, 1)
+		atomic.AddInt64(&l.numFailed, 1)
+		submission.failed(false)
+		writeResult(submission.chain, l.url, nil, "failed")
+	} else if ctr == nil {
+		writeResult(submission.chain, l.url, nil, "duplicate")
+	} else {
+		writeResult(submission.chain, l.url, ctr, "submitted")
+	}
+}
+
+// newLogClient returns the client used to talk to the logs, it honors the
+// proxy environment variables and trusts -logCAFile in addition to the system
+// roots
+func newLogClient() (*http.Client, error) {
+	perHost := *httpMaxIdleConnsPerHost
+	if perHost <= 0 {
+		perHost = *workers
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          *httpMaxIdleConns,
+		MaxIdleConnsPerHost:   perHost,
+		IdleConnTimeout:       *httpIdleConnTimeout,
+	}
+	if *logCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		contents, err := ioutil.ReadFile(*logCAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(contents) {
+			return nil, fmt.Errorf("no certificates found in %s", *logCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Timeout: *httpTimeout, Transport: transport}, nil
+}
+
+func submitChains(ctx context.Context, c httpClient, submissions chan chain, logs []*ctLog) error {
+	// each log gets its own queue, as deep as the submissions buffer, so a
+	// slow log can fall behind without holding up the others
+	queues := make([]chan *pendingChain, len(logs))
+	for i := range queues {
+		queues[i] = make(chan *pendingChain, cap(submissions))
+	}
+	go func() {
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
 		}()
+		for submission := range submissions {
+			targets := routeChain(submission, logs)
+			if len(targets) == 0 {
+				atomic.AddInt64(&numOutOfShard, 1)
+				logSkip(submission.ID, filteredError{errors.New("leaf expiry outside of every log's shard")})
+				progress.resolve(submission.ID)
+				continue
+			}
+			pc := &pendingChain{chain: submission, remaining: int32(len(targets))}
+			for _, i := range targets {
+				select {
+				case queues[i] <- pc:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for i, l := range logs {
+		wg.Add(1)
+		go func(l *ctLog, queue chan *pendingChain) {
+			l.run(ctx, c, queue)
+			wg.Done()
+		}(l, queues[i])
 	}
 	wg.Wait()
 	return nil
 }
 
-type ctSubmission struct {
-	Chain []string `json:"chain"`
+// bodyPool holds the buffers request bodies are built in, shared by every
+// worker so once the buffers have grown building a body only allocates the
+// copy the request is sent from
+var bodyPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
-func certsToSub(certs [][]byte) []byte {
-	sub := ctSubmission{}
-	for _, c := range certs {
-		sub.Chain = append(sub.Chain, base64.StdEncoding.EncodeToString(c))
+// certsToSub writes the add-chain request body for certs to buf, the same
+// bytes json.Marshal gives for {"chain": [base64 certs...]}. Base64 never
+// needs escaping in a JSON string so the certs are encoded straight into buf
+func certsToSub(buf *bytes.Buffer, certs [][]byte) error {
+	if certs == nil {
+		_, err := buf.WriteString(`{"chain":null}`)
+		return err
 	}
-	j, err := json.Marshal(sub)
-	if err != nil {
-		panic(err)
+	buf.WriteString(`{"chain":[`)
+	for i, c := range certs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Grow(base64.StdEncoding.EncodedLen(len(c)) + 2)
+		buf.WriteByte('"')
+		buf.Write(base64.StdEncoding.AppendEncode(buf.AvailableBuffer(), c))
+		buf.WriteByte('"')
+	}
+	_, err := buf.WriteString("]}")
+	return err
+}
+
+// stallPercent is how much of elapsed was spent stalled
+func stallPercent(stalled int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(stalled) / float64(elapsed) * 100
+}
+
+func submissionRate(delta int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(delta) / elapsed.Seconds()
+}
+
+// progressSummary renders resolved / total with a percentage and, once there
+// is a rate to go by, an ETA
+func progressSummary(resolved, total int64, rate float64) string {
+	s := fmt.Sprintf("[%d / %d (%.1f%%)", resolved, total, 100*float64(resolved)/float64(total))
+	if remaining := total - resolved; remaining > 0 && rate > 0 {
+		s += fmt.Sprintf(", ETA: %s", (time.Duration(float64(remaining)/rate) * time.Second).Round(time.Second))
+	}
+	return s + "]"
+}
+
+// statCounter is a counter shown in the stats output
+type statCounter struct {
+	name  string
+	value *int64
+}
+
+// the counters printStats groups onto their own lines, zero counters are only
+// shown with -verbose
+var (
+	skipCounters = []statCounter{
+		{"unorderable chains", &numUnorderable},
+		{"multi-leaf chains", &numMultiLeaf},
+		{"expired", &numExpiredSkipped},
+		{"outside shard", &numOutOfShard},
+		{"outside NotBefore window", &numOutsideNotBefore},
+		{"unparseable leaves", &numUnparseableLeaf},
+		{"invalid DER", &numInvalidDER},
+		{"no intermediates", &numNoIntermediate},
+		{"dangling certs", &numDanglingCert},
+		{"unknown roots", &numUnknownRoot},
+		{"self-signed leaves", &numSelfSignedLeaf},
+		{"filtered", &numFiltered},
+		{"in-flight duplicates", &numInFlightDup},
+		{"already submitted", &numDedupSkipped},
+		{"oversized", &numOversized},
+		{"sampled out", &numSampledOut},
+		{"no leaf", &numSkippedNoLeaf},
+		{"cert fetch", &numSkippedCertFetch},
+	}
+	adjustCounters = []statCounter{
+		{"duplicate certs removed", &numDuplicateCerts},
+		{"excluded certs", &numExcludedCerts},
+		{"no leaf (first cert used)", &numNoLeafFirst},
+		{"leaf-only submissions", &numLeafOnly},
+		{"already logged", &numDuplicateOK},
+	}
+	errorCounters = []statCounter{
+		{"bad SCTs", &numBadSCT},
+		{"submit failures", &numSubmitFailed},
+		{"marshal failures", &numMarshalFailed},
 	}
-	return j
+)
+
+// formatCounters renders counters as "name: value" pairs, leaving out the zero
+// ones unless all is set
+func formatCounters(counters []statCounter, all bool) string {
+	var fields []string
+	for _, c := range counters {
+		if v := atomic.LoadInt64(c.value); v != 0 || all {
+			fields = append(fields, fmt.Sprintf("%s: %d", c.name, v))
+		}
+	}
+	return strings.Join(fields, ", ")
 }
 
-func printStats(t *time.Ticker, chains chan []chain, submissions chan chain) {
+// printStats prints the stats every tick of t until stop is closed
+func printStats(t *time.Ticker, stop chan struct{}, chains chan []chain, submissions chan chain, logs []*ctLog) {
 	lastNumSubmitted := int64(0)
-	rate := 0.0
-	for range t.C {
+	lastNumRead := int64(0)
+	lastNumCerts := int64(0)
+	lastStalled := int64(0)
+	lastResolved := int64(0)
+	lastTick := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-stop:
+			return
+		}
 		num := atomic.LoadInt64(&numSubmitted)
-		rate = float64(num-lastNumSubmitted) / 30.0
-		fmt.Printf(
-			"%s [pending chains: %d, pending submissions: %d, completed submissions: %d (%d new), submission rate: %3.2f/s, last submitted chain id: %d]\n",
+		rate := submissionRate(num-lastNumSubmitted, now.Sub(lastTick))
+		numRead := atomic.LoadInt64(&numChainsRead)
+		numCerts := atomic.LoadInt64(&numCertsFetched)
+		stalled := atomic.LoadInt64(&producerStalledNanos)
+		fmt.Fprintf(
+			statsOut,
+			"%s [pending chains: %d, pending submissions: %d, completed submissions: %d (%d new), rejected: %d, failed: %d, submission rate: %3.2f/s, read rate: %3.2f chains/s, cert fetch rate: %3.2f/s, producer stall: %3.1f%%, paused: %t, last submitted chain id: %d]\n",
 			time.Now().Format(time.RFC1123),
 			len(chains)*maxChains,
 			len(submissions),
 			num,
 			atomic.LoadInt64(&numNewSubmitted),
+			atomic.LoadInt64(&numRejected),
+			atomic.LoadInt64(&numFailed),
 			rate,
+			submissionRate(numRead-lastNumRead, now.Sub(lastTick)),
+			submissionRate(numCerts-lastNumCerts, now.Sub(lastTick)),
+			stallPercent(stalled-lastStalled, now.Sub(lastTick)),
+			paused.isPaused(),
 			atomic.LoadInt64(&lastSubmittedChain),
 		)
+		for _, group := range []struct {
+			name     string
+			counters []statCounter
+		}{{"skipped", skipCounters}, {"adjusted", adjustCounters}, {"errors", errorCounters}} {
+			if line := formatCounters(group.counters, *verbose); line != "" {
+				fmt.Fprintf(statsOut, "\t%s [%s]\n", group.name, line)
+			}
+		}
+		resolved := atomic.LoadInt64(&numResolved)
+		if total := atomic.LoadInt64(&totalChains); total > 0 {
+			fmt.Fprintf(statsOut, "\tprogress %s\n", progressSummary(resolved, total, submissionRate(resolved-lastResolved, now.Sub(lastTick))))
+		}
+		if latest, ok := latestSCT.Load().(*sctSummary); ok {
+			fmt.Fprintf(statsOut, "\tlatest SCT %s\n", latest)
+		}
+		for _, l := range logs {
+			breaker := ""
+			if l.breaker != nil {
+				state, trips := l.breaker.status()
+				breaker = fmt.Sprintf(", breaker: %s (opened %d times)", state, trips)
+			}
+			fmt.Fprintf(
+				statsOut,
+				"\t%s [submitted: %d (%d new), rejected: %d, failed: %d, skipped: %d%s]\n",
+				l.url,
+				atomic.LoadInt64(&l.numSubmitted),
+				atomic.LoadInt64(&l.numNewSubmitted),
+				atomic.LoadInt64(&l.numRejected),
+				atomic.LoadInt64(&l.numFailed),
+				atomic.LoadInt64(&l.numSkipped),
+				breaker,
+			)
+		}
+		checkpoint()
 		lastNumSubmitted = num
+		lastNumRead = numRead
+		lastNumCerts = numCerts
+		lastStalled = stalled
+		lastResolved = resolved
+		lastTick = now
 	}
 }
 
+// Exit codes, so wrappers can tell failures apart
+const (
+	exitDB       = 2
+	exitConfig   = 3
+	exitPipeline = 4
+	// only for -chainFP, the chain wasn't accepted by every log
+	exitRejected = 5
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (ee exitError) Error() string {
+	return ee.err.Error()
+}
+
 func main() {
 	flag.Parse()
-	chainsCh := make(chan []chain, 100)
-	submissions := make(chan chain, 100000)
+	if *showVersion {
+		fmt.Printf("dso-to-ct %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx)
+	stop()
+	if err != nil {
+		slog.Error(err.Error())
+		code := 1
+		if ee, ok := err.(exitError); ok {
+			code = ee.code
+		}
+		os.Exit(code)
+	}
+}
 
-	innerDB, err := sql.Open("mysql", *dbURI)
+func run(ctx context.Context) error {
+	started := time.Now()
+	explicit := commandLineFlags()
+	if *configFile != "" {
+		err := loadConfig(*configFile, explicit)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		return exitError{exitConfig, err}
+	}
+	if len(logURLs) == 0 {
+		logURLs = stringList{logAddr}
+	}
+	switch *onMultiLeaf {
+	case "skip", "first", "error":
+	default:
+		return exitError{exitConfig, fmt.Errorf("invalid -onMultiLeaf %q, must be skip, first, or error", *onMultiLeaf)}
+	}
+	requestSlots = newSemaphore(*maxInFlight)
+	if *ordered && *workers != 1 {
+		// the sources and fetchCerts already keep chains in ID order
+		slog.Info("-ordered uses a single worker per log", "workers", *workers)
+		*workers = 1
+	}
+	if *treatDuplicateAsSuccess {
+		if *duplicateStatus == 0 && *duplicateBodyPattern == "" {
+			return exitError{exitConfig, errors.New("-treatDuplicateAsSuccess needs -duplicateStatus or -duplicateBodyPattern")}
+		}
+		if *duplicateBodyPattern != "" {
+			var err error
+			duplicateBody, err = regexp.Compile(*duplicateBodyPattern)
+			if err != nil {
+				return exitError{exitConfig, fmt.Errorf("invalid -duplicateBodyPattern: %s", err)}
+			}
+		}
+	}
+	if err := setTableNames(*chainsTable, *reportsTable, *certsTable); err != nil {
+		return exitError{exitConfig, err}
+	}
+	for _, name := range []string{*sctOutputTable, *submittedAtColumn, *logSCTsColumn} {
+		if name == "" {
+			continue
+		}
+		if err := validIdentifier(name); err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if *sctOutputTable != "" || *markSubmitted || *sctsFile != "" {
+		if err := checkBatchFlags(); err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if err := checkSourceFlags(); err != nil {
+		return exitError{exitConfig, err}
+	}
+	switch *noLeafPolicy {
+	case "skip", "submitFirst", "error":
+	default:
+		return exitError{exitConfig, fmt.Errorf("invalid -noLeafPolicy %q, must be skip, submitFirst, or error", *noLeafPolicy)}
+	}
+	var logs []*ctLog
+	for _, u := range logURLs {
+		err := validateLogURL(u, *allowInsecureLog)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		l := &ctLog{
+			url:       u,
+			base:      strings.TrimSuffix(strings.TrimSuffix(u, "/"), addChainPath),
+			authToken: *logAuthToken,
+			leafOnly:  *leafOnly,
+			breaker:   newCircuitBreaker(*breakerThreshold, *breakerCooldown),
+		}
+		if *maxRate > 0 {
+			l.limiter = rate.NewLimiter(rate.Limit(*maxRate), 1)
+		}
+		logs = append(logs, l)
+	}
+	for _, u := range leafOnlyLogs {
+		found := false
+		for _, l := range logs {
+			if l.url == u {
+				l.leafOnly = true
+				found = true
+			}
+		}
+		if !found {
+			return exitError{exitConfig, fmt.Errorf("-leafOnlyLog given for unknown log %q", u)}
+		}
+	}
+	for _, entry := range logAuth {
+		// tokens may well contain '=' but log URLs shouldn't
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return exitError{exitConfig, errors.New("invalid -logAuth entry, must be <logURL>=<token>")}
+		}
+		found := false
+		for _, l := range logs {
+			if l.url == entry[:i] {
+				l.authToken = entry[i+1:]
+				found = true
+			}
+		}
+		if !found {
+			return exitError{exitConfig, fmt.Errorf("-logAuth given for unknown log %q", entry[:i])}
+		}
+	}
+	for _, entry := range logShards {
+		u, sw, err := parseLogShard(entry)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		found := false
+		for _, l := range logs {
+			if l.url == u {
+				l.shard = sw
+				found = true
+			}
+		}
+		if !found {
+			return exitError{exitConfig, fmt.Errorf("-logShard given for unknown log %q", u)}
+		}
+	}
+	logClient, err := newLogClient()
 	if err != nil {
-		panic(err)
+		return exitError{exitConfig, err}
+	}
+	var c httpClient = logClient
+	// -dryRunDir implies -dryRun, the payloads are written out instead of sent.
+	// -dryRunProbe implies it too, but checks the logs with real read-only
+	// requests first. Everything from here on only needs to check -dryRun
+	if *dryRunDir != "" {
+		*dryRun = true
+	}
+	if *dryRunProbe || *dryRunProbeRoots {
+		*dryRun = true
+		if err := probeLogs(logClient, logs, *dryRunProbeRoots); err != nil {
+			return exitError{exitPipeline, err}
+		}
+	}
+	if *dryRun {
+		c = newDryClient(*httpTimeout)
+	} else {
+		for _, l := range logs {
+			go l.refreshSTH(ctx, logClient, *statPeriod)
+		}
+	}
+	if *prefilterRoots {
+		// roots are fetched for real even for dry runs
+		acceptedRoots, err = fetchRoots(logClient, logs)
+		if err != nil {
+			return exitError{exitPipeline, fmt.Errorf("failed to fetch log roots: %s", err)}
+		}
+	}
+	if len(excludeFingerprints) > 0 {
+		var err error
+		excludedCerts, err = parseFingerprints(excludeFingerprints)
+		if err != nil {
+			return exitError{exitConfig, fmt.Errorf("invalid -excludeFingerprints: %s", err)}
+		}
+	}
+	if len(logPublicKeys) > 0 {
+		var err error
+		logKeys, err = parseLogKeys(logPublicKeys)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if *checkpointFile != "" {
+		if !explicit["initialChainID"] {
+			id, ok, err := readCheckpoint(*checkpointFile)
+			if err != nil {
+				return exitError{exitConfig, err}
+			}
+			if ok {
+				*initialChainID = id
+			}
+		}
+	}
+	submissions := make(chan chain, *submissionBuffer)
+
+	usePEM := *pemFile != "" || *pemDir != ""
+	useDB := !usePEM && *sourceLogURL == ""
+	// chains and certs are read from readDB, which is the replica if there is
+	// one, everything else uses db
+	var db, readDB *gorp.DbMap
+	if useDB || *sctOutputTable != "" || *dedupFromSCTs {
+		dialect, err := dialectFor(*dbDriver)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		db, err = openDB(ctx, dialect, *dbURI)
+		if err != nil {
+			return exitError{exitDB, err}
+		}
+		readDB = db
+		if useDB && *replicaDBURI != "" {
+			readDB, err = openDB(ctx, dialect, *replicaDBURI)
+			if err != nil {
+				return exitError{exitDB, fmt.Errorf("replica: %s", err)}
+			}
+		}
+		if *createSchema {
+			if *dbDriver != "sqlite" {
+				return exitError{exitConfig, errors.New("-createSchema is only supported with -dbDriver sqlite")}
+			}
+			if err := createSQLiteSchema(db, *sctOutputTable); err != nil {
+				return exitError{exitDB, fmt.Errorf("failed to create schema: %s", err)}
+			}
+		}
+	}
+	if useDB && !*skipSchemaCheck {
+		chainColumns := []string{"chain_fp", "chain_id", "valid"}
+		if *markSubmitted {
+			chainColumns = append(chainColumns, *submittedAtColumn, *logSCTsColumn)
+		}
+		err := checkSchema(ctx, readDB, map[string][]string{
+			*chainsTable:  chainColumns,
+			*reportsTable: {"chain_fp", "cert_fp", "is_end_entity"},
+			*certsTable:   {"cert_fp", "raw_cert"},
+		})
+		if err != nil {
+			return exitError{exitDB, err}
+		}
+	}
+	if *chainFP != "" {
+		return submitSingleChain(ctx, readDB, c, logs, *chainFP)
+	}
+	// the source is stopped as soon as we're done queueing, which may be
+	// before it is exhausted if -limit is hit
+	sourceCtx, stopSource := context.WithCancel(ctx)
+	defer stopSource()
+	var source chainSource
+	var chainsCh chan []chain
+	switch {
+	case usePEM:
+		var err error
+		source, err = newPEMSource(*pemFile, *pemDir)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+	case *sourceLogURL != "":
+		if err := validateLogURL(*sourceLogURL, *allowInsecureLog); err != nil {
+			return exitError{exitConfig, err}
+		}
+		// entries are always read for real, even for dry runs
+		var err error
+		source, err = newEntriesSource(sourceCtx, logClient, *sourceLogURL, *sourceStart, *sourceEnd)
+		if err != nil {
+			return exitError{exitPipeline, fmt.Errorf("failed to read source log: %s", err)}
+		}
+	case *resubmitFile != "":
+		if *checkpointFile != "" {
+			return exitError{exitConfig, errors.New("-resubmitFile can't be used with -checkpointFile")}
+		}
+		var err error
+		source, err = newResubmitSource(sourceCtx, readDB, *resubmitFile)
+		if err != nil {
+			return exitError{exitDB, fmt.Errorf("failed to read chains to resubmit: %s", err)}
+		}
+	default:
+		if !*noSnapshot {
+			err := withReconnect(ctx, readDB, func(ctx context.Context) error {
+				var err error
+				lastChainID, err = readDB.WithContext(ctx).SelectInt(tableQuery(selectMaxChainID))
+				return err
+			})
+			if err != nil {
+				return exitError{exitDB, fmt.Errorf("failed to snapshot last chain ID: %s", err)}
+			}
+			slog.Info("reading chains up to snapshot", "last_chain_id", lastChainID)
+		}
+		if *countTotal {
+			var total int64
+			err := withReconnect(ctx, readDB, func(ctx context.Context) error {
+				var err error
+				total, err = readDB.WithContext(ctx).SelectInt(rebind(readDB.Dialect, tableQuery(unsubmittedOnly(countChains))), *initialChainID, lastChainID)
+				return err
+			})
+			if err != nil {
+				// progress just isn't shown
+				slog.Warn("failed to count chains", "err", err)
+			}
+			atomic.StoreInt64(&totalChains, total)
+		}
+		ds := newDBSource(sourceCtx, readDB)
+		source, chainsCh = ds, ds.pages
+	}
+	if *sctOutputTable != "" {
+		sctStore = newSCTWriter(db, *sctOutputTable, *sctFallbackFile)
+	}
+	if *lazyCerts {
+		switch {
+		case !useDB:
+			return exitError{exitConfig, errors.New("-lazyCerts only applies to chains read from the database")}
+		case len(logShards) > 0:
+			return exitError{exitConfig, errors.New("-lazyCerts can't be used with -logShard, routing needs the leaf")}
+		case *onMultiLeaf == "error" || *noLeafPolicy == "error":
+			return exitError{exitConfig, errors.New("-lazyCerts can't stop the run on a bad chain, -onMultiLeaf and -noLeafPolicy can't be error")}
+		}
+		lazy = &lazyLoader{db: readDB, cache: newCertCache(*certCacheSize)}
+	}
+	if *markSubmitted {
+		if !useDB {
+			return exitError{exitConfig, errors.New("-markSubmitted needs chains read from the database")}
+		}
+		if *dryRun {
+			return exitError{exitConfig, errors.New("-markSubmitted can't be used with dry runs")}
+		}
+		marker = newSubmittedMarker(db)
+	}
+	if *dedupCache != "" || *dedupFromSCTs {
+		dedup = newDedupSet()
+		if *dedupCache != "" {
+			err := dedup.open(*dedupCache)
+			if err != nil {
+				return exitError{exitConfig, err}
+			}
+			defer func() {
+				if err := dedup.close(); err != nil {
+					slog.Error("failed to write dedup cache", "err", err)
+				}
+			}()
+		}
+		if *dedupFromSCTs {
+			if *sctOutputTable == "" {
+				return exitError{exitConfig, errors.New("-dedupFromSCTs requires -sctOutputTable")}
+			}
+			err := dedup.loadSCTs(ctx, db, *sctOutputTable)
+			if err != nil {
+				return exitError{exitDB, fmt.Errorf("failed to load SCTs for dedup: %s", err)}
+			}
+		}
+	}
+
+	if *dryRunDir != "" {
+		err := os.MkdirAll(*dryRunDir, 0755)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if *saveResponses && *responseDir == "" {
+		return exitError{exitConfig, errors.New("-saveResponses requires -responseDir")}
+	}
+	if *responseDir != "" {
+		err := os.MkdirAll(*responseDir, 0755)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+	}
+	if *jsonOutput != "" {
+		var err error
+		results, err = openResultWriter(*jsonOutput)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		defer results.close()
+		if *jsonOutput == "-" {
+			statsOut = os.Stderr
+		}
+	}
+	if *csvOutput != "" {
+		var err error
+		csvResults, err = openCSVWriter(*csvOutput)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		defer csvResults.close()
+	}
+	if *sctsFile != "" {
+		var err error
+		sctLog, err = openSCTFile(*sctsFile)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		defer func() {
+			if err := sctLog.close(); err != nil {
+				slog.Error("failed to close SCTs file", "err", err)
+			}
+		}()
+	}
+	if *rejectLogFile != "" {
+		var err error
+		rejects, err = openRejectLog(*rejectLogFile)
+		if err != nil {
+			return exitError{exitConfig, err}
+		}
+		defer rejects.close()
+	}
+
+	if *dryRun {
+		fmt.Fprintf(statsOut, "# [Dry run, requests would be sent with User-Agent: %q]\n", *userAgent)
+		for _, l := range logs {
+			if l.authToken != "" {
+				fmt.Fprintf(statsOut, "# [Dry run, requests to %s would be sent with %s: <redacted>]\n", l.url, *logAuthHeader)
+			}
+		}
 	}
-	db := &gorp.DbMap{Db: innerDB, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
 
 	defer func() {
 		// record last submitted chain id
-		var recovered interface{}
-		if r := recover(); r != nil {
-			recovered = r
-		}
-		fmt.Printf("\n# [Last submitted chain ID: %d]\n", atomic.LoadInt64(&lastSubmittedChain))
-		if recovered != nil {
-			fmt.Println("ERROR", recovered)
-			os.Exit(1)
+		fmt.Fprintf(statsOut, "\n# [Last submitted chain ID: %d]\n", atomic.LoadInt64(&lastSubmittedChain))
+		fmt.Fprintf(statsOut, "# [All chains resolved up to ID: %d]\n", progress.get())
+		checkpoint()
+		summary := summarize(started)
+		summary.print(statsOut)
+		if *summaryFile != "" {
+			if err := writeSummary(*summaryFile, summary); err != nil {
+				slog.Error("failed to write summary", "err", err)
+			}
 		}
 	}()
 
 	t := time.NewTicker(*statPeriod)
-	go printStats(t, chainsCh, submissions)
-
+	stopStats, statsDone := make(chan struct{}), make(chan struct{})
 	go func() {
-		err := getChains(db, chainsCh)
-		if err != nil {
-			panic(err)
-		}
-		close(chainsCh)
+		printStats(t, stopStats, chainsCh, submissions, logs)
+		close(statsDone)
 	}()
+	// runs before the summary is printed, so a last stats line can't end up
+	// in the middle of it
+	defer func() {
+		t.Stop()
+		close(stopStats)
+		<-statsDone
+	}()
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr, submissions, logs)
+	}
+	if *pprofAddr != "" {
+		servePprof(*pprofAddr)
+	}
+	atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+	if *healthAddr != "" {
+		serveHealth(*healthAddr)
+	}
+	handlePauseSignals(ctx)
 
-	finished := make(chan struct{}, 1)
+	finished := make(chan error, 1)
 	go func() {
-		err := submitChains(submissions)
-		if err != nil {
-			panic(err)
-		}
-		finished <- struct{}{}
+		finished <- submitChains(ctx, c, submissions, logs)
 	}()
 
-	for chains := range chainsCh {
+	// on shutdown stop queueing new chains and give the workers up to
+	// -shutdownTimeout to finish whatever they are currently submitting
+	var sourceErr error
+feed:
+	for {
+		chains, err := source.Next()
+		if err != nil {
+			if err != io.EOF {
+				sourceErr = err
+			}
+			break
+		}
+		atomic.StoreInt32(&ready, 1)
 		for _, partialChain := range chains {
-			err := getCerts(db, &partialChain)
-			if err != nil {
-				// panic(err)
-				continue // skip broken chains
+			if ctx.Err() != nil {
+				break feed
+			}
+			if *limit > 0 && atomic.AddInt64(&numQueued, 1) > *limit {
+				break feed
+			}
+			progress.add(partialChain.ID)
+			select {
+			case submissions <- partialChain:
+				atomic.AddInt64(&numEnqueued, 1)
+				continue
+			default:
 			}
-			submissions <- partialChain
+			stalledAt := time.Now()
+			select {
+			case submissions <- partialChain:
+				atomic.AddInt64(&numEnqueued, 1)
+			case <-ctx.Done():
+				atomic.AddInt64(&producerStalledNanos, int64(time.Since(stalledAt)))
+				break feed
+			}
+			atomic.AddInt64(&producerStalledNanos, int64(time.Since(stalledAt)))
 		}
 	}
+	stopSource()
 	close(submissions)
-	<-finished
+	var submitErr error
+	select {
+	case submitErr = <-finished:
+	case <-ctx.Done():
+		select {
+		case submitErr = <-finished:
+		case <-time.After(*shutdownTimeout):
+			fmt.Fprintln(statsOut, "# [Timed out waiting for submissions to finish]")
+		}
+	}
+	if sctStore != nil {
+		sctStore.close()
+	}
+	if marker != nil {
+		marker.close()
+	}
+	if submitErr != nil {
+		return exitError{exitPipeline, submitErr}
+	}
+	if sourceErr != nil {
+		if _, ok := sourceErr.(exitError); ok {
+			return sourceErr
+		}
+		return exitError{exitPipeline, fmt.Errorf("failed to read chains: %s", sourceErr)}
+	}
+	return nil
 }
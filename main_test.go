@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	post := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://log/ct/v1/add-chain", Err: err}
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", post(context.DeadlineExceeded), true},
+		{"connection refused", post(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{"connection reset", post(syscall.ECONNRESET), true},
+		{"server hung up", post(io.EOF), true},
+		{"truncated response", post(io.ErrUnexpectedEOF), true},
+		{"malformed URL", &url.Error{Op: "parse", URL: "://log", Err: errors.New("missing protocol scheme")}, false},
+		{"unknown authority", post(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), false},
+		{"wrong hostname", post(x509.HostnameError{Certificate: new(x509.Certificate), Host: "log"}), false},
+		{"expired", post(x509.CertificateInvalidError{Reason: x509.Expired}), false},
+		{"other", errors.New("stopped after 10 redirects"), false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("%s: isTransient(%q) = %t, want %t", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestCertsToSub(t *testing.T) {
+	chain, _ := testChain(t)
+	for _, certs := range [][][]byte{nil, {}, chain[:1], chain} {
+		want, err := json.Marshal(struct {
+			Chain [][]byte `json:"chain"`
+		}{certs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := certsToSub(&buf, certs); err != nil {
+			t.Fatalf("certsToSub failed: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("certsToSub = %s, want %s", buf.Bytes(), want)
+		}
+	}
+}
+
+// the pooled benchmark should report no allocations, compared to the fresh
+// buffer and json.Marshal the pool replaced
+func BenchmarkCertsToSubPooled(b *testing.B) {
+	chain, _ := testChain(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := bodyPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		certsToSub(buf, chain)
+		bodyPool.Put(buf)
+	}
+}
+
+func BenchmarkCertsToSubUnpooled(b *testing.B) {
+	chain, _ := testChain(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		certsToSub(new(bytes.Buffer), chain)
+	}
+}
+
+func BenchmarkCertsToSubMarshal(b *testing.B) {
+	chain, _ := testChain(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		body, _ := json.Marshal(struct {
+			Chain [][]byte `json:"chain"`
+		}{chain})
+		bytes.NewBuffer(body)
+	}
+}
+
+func TestSubmissionRate(t *testing.T) {
+	if got := submissionRate(50, 5*time.Second); got != 10 {
+		t.Errorf("submissionRate(50, 5s) = %f, want 10", got)
+	}
+	if got := submissionRate(50, 0); got != 0 {
+		t.Errorf("submissionRate(50, 0) = %f, want 0", got)
+	}
+	// printStats divides by the time between ticks, not a fixed period
+	zeroCounters(t, &numSubmitted, &numChainsRead, &numCertsFetched, &totalChains)
+	numSubmitted = 25
+	var out bytes.Buffer
+	setValue[io.Writer](t, &statsOut, &out)
+	tick, stop, done := make(chan time.Time), make(chan struct{}), make(chan struct{})
+	go func() {
+		printStats(&time.Ticker{C: tick}, stop, nil, nil, nil)
+		close(done)
+	}()
+	tick <- time.Now().Add(5 * time.Second)
+	close(stop)
+	<-done
+	if !strings.Contains(out.String(), "submission rate: 5.00/s") {
+		t.Errorf("stats for 25 submissions over 5s = %q, want a 5.00/s rate", out.String())
+	}
+}
+
+func TestFormatCounters(t *testing.T) {
+	zero, three := int64(0), int64(3)
+	counters := []statCounter{{"zero", &zero}, {"three", &three}}
+	if got := formatCounters(counters, false); got != "three: 3" {
+		t.Errorf("formatCounters = %q, want %q", got, "three: 3")
+	}
+	if got := formatCounters(counters, true); got != "zero: 0, three: 3" {
+		t.Errorf("formatCounters with all = %q, want %q", got, "zero: 0, three: 3")
+	}
+	if got := formatCounters([]statCounter{{"zero", &zero}}, false); got != "" {
+		t.Errorf("formatCounters with only zeros = %q, want nothing", got)
+	}
+}
+
+func TestProgressSummary(t *testing.T) {
+	for _, tc := range []struct {
+		resolved, total int64
+		rate            float64
+		want            string
+	}{
+		{50, 200, 10, "[50 / 200 (25.0%), ETA: 15s]"},
+		{50, 200, 0, "[50 / 200 (25.0%)]"},
+		{200, 200, 10, "[200 / 200 (100.0%)]"},
+	} {
+		if got := progressSummary(tc.resolved, tc.total, tc.rate); got != tc.want {
+			t.Errorf("progressSummary(%d, %d, %f) = %q, want %q", tc.resolved, tc.total, tc.rate, got, tc.want)
+		}
+	}
+}
+
+func TestSkippedChainsResolve(t *testing.T) {
+	zeroCounters(t, &numResolved, &numSampledOut, &numRejected, &numFailed)
+	defer func(old int64) { *sampleEvery = old }(*sampleEvery)
+	*sampleEvery = 2
+	// sampled out, skipped by a source, and resolved by the pipeline
+	sampledOut(1)
+	logSkip(3, filteredError{errors.New("filtered")})
+	progress.add(4)
+	pc := &pendingChain{chain: chain{ID: 4}, remaining: 2}
+	pc.failed(true)
+	pc.failed(false)
+	if numResolved != 3 {
+		t.Errorf("%d chains resolved, want 3", numResolved)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-gorp/gorp"
+)
+
+// marker is nil unless -markSubmitted is set
+var marker *submittedMarker
+
+type submittedMark struct {
+	chainID int64
+	at      time.Time
+	scts    int32
+}
+
+// submittedMarker records chains every log accepted back in the chains
+// table, setting -submittedAtColumn to when and -logSCTsColumn to how many
+// SCTs were returned. Like SCTs the updates are batched by -sctBatchSize and
+// -sctFlushInterval, each batch in one transaction
+type submittedMarker struct {
+	*batcher[submittedMark]
+	db *gorp.DbMap
+}
+
+func newSubmittedMarker(db *gorp.DbMap) *submittedMarker {
+	sm := &submittedMarker{db: db}
+	sm.batcher = newBatcher(*sctBatchSize, *sctFlushInterval, sm.flush)
+	return sm
+}
+
+func (sm *submittedMarker) add(chainID int64, scts int32) {
+	if sm == nil {
+		return
+	}
+	sm.batcher.add(submittedMark{chainID: chainID, at: time.Now().UTC(), scts: scts})
+}
+
+func (sm *submittedMarker) flush(batch []submittedMark) {
+	// the chains are just submitted again by the next run
+	if err := sm.update(batch); err != nil {
+		slog.Error("failed to mark chains submitted", "count", len(batch), "err", err)
+	}
+}
+
+func (sm *submittedMarker) update(batch []submittedMark) error {
+	query := rebind(sm.db.Dialect, tableQuery(fmt.Sprintf("UPDATE {chains} SET %s = ?, %s = ? WHERE chain_id = ?", *submittedAtColumn, *logSCTsColumn)))
+	return withReconnect(context.Background(), sm.db, func(ctx context.Context) error {
+		tx, err := sm.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, m := range batch {
+			_, err = tx.WithContext(ctx).Exec(query, m.at, m.scts, m.chainID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// unsubmittedOnly restricts a chains query to the chains that haven't been
+// marked submitted yet when -markSubmitted is set
+func unsubmittedOnly(query string) string {
+	if !*markSubmitted {
+		return query
+	}
+	return strings.Replace(query, "WHERE valid = 1", fmt.Sprintf("WHERE valid = 1 AND %s IS NULL", *submittedAtColumn), 1)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// submitLatency is always observed but only exported when -metricsAddr is set
+var submitLatency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "dso_to_ct_submit_latency_seconds",
+		Help:    "Latency of individual add-chain requests.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"log"},
+)
+
+// responseStatuses is also always counted, statusCounts keeps the totals
+// across logs for the summary
+var (
+	responseStatuses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dso_to_ct_responses_total",
+			Help: "add-chain responses by HTTP status code.",
+		},
+		[]string{"log", "code"},
+	)
+	statusCounts = struct {
+		sync.Mutex
+		m map[int]int64
+	}{m: map[int]int64{}}
+)
+
+// countStatus records the status code of a response from l
+func countStatus(l *ctLog, code int) {
+	responseStatuses.WithLabelValues(l.url, strconv.Itoa(code)).Inc()
+	statusCounts.Lock()
+	statusCounts.m[code]++
+	statusCounts.Unlock()
+}
+
+// statusBreakdown returns how many responses had each status code
+func statusBreakdown() map[int]int64 {
+	statusCounts.Lock()
+	defer statusCounts.Unlock()
+	counts := make(map[int]int64, len(statusCounts.m))
+	for code, n := range statusCounts.m {
+		counts[code] = n
+	}
+	return counts
+}
+
+func counterFunc(name, help string, labels prometheus.Labels, v *int64) prometheus.Collector {
+	return prometheus.NewCounterFunc(
+		prometheus.CounterOpts{Name: name, Help: help, ConstLabels: labels},
+		func() float64 { return float64(atomic.LoadInt64(v)) },
+	)
+}
+
+// serveMetrics exposes the same atomic counters printStats reads, so both can
+// run at once without either resetting the other
+func serveMetrics(addr string, submissions chan chain, logs []*ctLog) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		counterFunc("dso_to_ct_chains_submitted_total", "Chains accepted by every log.", nil, &numSubmitted),
+		counterFunc("dso_to_ct_chains_new_total", "Submitted chains with a fresh SCT from at least one log.", nil, &numNewSubmitted),
+		counterFunc("dso_to_ct_chains_failed_total", "Chains at least one log failed to accept.", nil, &numFailed),
+		counterFunc("dso_to_ct_chains_rejected_total", "Chains at least one log permanently rejected.", nil, &numRejected),
+		counterFunc("dso_to_ct_bad_scts_total", "SCTs that failed signature verification.", nil, &numBadSCT),
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{Name: "dso_to_ct_pending_submissions", Help: "Chains buffered waiting for submission."},
+			func() float64 { return float64(len(submissions)) },
+		),
+		submitLatency,
+		responseStatuses,
+		requestPhases,
+	)
+	for _, l := range logs {
+		labels := prometheus.Labels{"log": l.url}
+		reg.MustRegister(
+			counterFunc("dso_to_ct_log_submitted_total", "Chains accepted by a log.", labels, &l.numSubmitted),
+			counterFunc("dso_to_ct_log_new_total", "Chains a log returned a fresh SCT for.", labels, &l.numNewSubmitted),
+			counterFunc("dso_to_ct_log_failed_total", "Chains a log failed to accept.", labels, &l.numFailed),
+			counterFunc("dso_to_ct_log_rejected_total", "Chains a log permanently rejected.", labels, &l.numRejected),
+		)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go serve("metrics", addr, mux)
+}
+
+// servePprof registers the pprof handlers on their own mux, rather than
+// http.DefaultServeMux, so they are only reachable on -pprofAddr
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go serve("pprof", addr, mux)
+}
+
+// lastProgress is the UnixNano time of the last completed submission, run
+// seeds it at startup. ready is set once the chain source has produced its
+// first page
+var (
+	lastProgress int64
+	ready        int32
+)
+
+// serveHealth serves /healthz, which fails once no submission has completed
+// for four stats intervals unless submissions are paused, /ready, and the
+// POST /pause and /resume controls
+func serveHealth(addr string) {
+	stale := 4 * *statPeriod
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if paused.isPaused() {
+			fmt.Fprintln(w, "ok (paused)")
+			return
+		}
+		since := time.Since(time.Unix(0, atomic.LoadInt64(&lastProgress)))
+		if since > stale {
+			http.Error(w, fmt.Sprintf("no progress in %s", since.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/pause", pauseHandler(true))
+	mux.HandleFunc("/resume", pauseHandler(false))
+	go serve("health", addr, mux)
+}
+
+func serve(name, addr string, handler http.Handler) {
+	err := http.ListenAndServe(addr, handler)
+	if err != nil {
+		slog.Error("server failed", "server", name, "err", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockResponse is a scripted response from a mockLog, a zero status sends a
+// well-formed SCT as usual after any delay, timestamped now unless timestamp
+// is set
+type mockResponse struct {
+	status     int
+	retryAfter string
+	body       string
+	delay      time.Duration
+	timestamp  int64
+}
+
+// mockLog is a CT log served with httptest. It checks every add-chain and
+// add-pre-chain request the way a real log would and, once any scripted
+// responses are used up, returns an SCT signed with key
+type mockLog struct {
+	*httptest.Server
+	t   testing.TB
+	key *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	script []mockResponse
+	// chains holds the chains of the well-formed requests, in order
+	chains   [][][]byte
+	requests int
+	// header is the last request's headers, conns counts the connections
+	// clients opened
+	header http.Header
+	conns  int
+}
+
+func newMockLog(t testing.TB) *mockLog {
+	t.Helper()
+	ml := &mockLog{t: t, key: newTestKey(t)}
+	ml.Server = httptest.NewUnstartedServer(http.HandlerFunc(ml.serve))
+	ml.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			ml.mu.Lock()
+			ml.conns++
+			ml.mu.Unlock()
+		}
+	}
+	ml.Start()
+	t.Cleanup(ml.Close)
+	return ml
+}
+
+// respond queues responses to send, in order, before going back to SCTs
+func (ml *mockLog) respond(responses ...mockResponse) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	ml.script = append(ml.script, responses...)
+}
+
+func (ml *mockLog) requestCount() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.requests
+}
+
+func (ml *mockLog) lastHeader() http.Header {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.header
+}
+
+func (ml *mockLog) connCount() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return ml.conns
+}
+
+// log returns a ctLog for the mock, as run would build it for -logURL
+func (ml *mockLog) log() *ctLog {
+	return &ctLog{url: ml.URL + addChainPath, base: ml.URL}
+}
+
+// keyring returns a keyring with the mock's key, for -logPublicKey
+func (ml *mockLog) keyring() keyring {
+	return testKeyring(ml.t, ml.key)
+}
+
+func (ml *mockLog) serve(w http.ResponseWriter, r *http.Request) {
+	ml.mu.Lock()
+	ml.requests++
+	ml.header = r.Header.Clone()
+	var next *mockResponse
+	if len(ml.script) > 0 {
+		next = &ml.script[0]
+		ml.script = ml.script[1:]
+	}
+	ml.mu.Unlock()
+
+	c, err := ml.parseRequest(r)
+	if err != nil {
+		ml.t.Errorf("mock log got a bad request: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timestamp := time.Now().UnixMilli()
+	if next != nil {
+		time.Sleep(next.delay)
+		if next.timestamp != 0 {
+			timestamp = next.timestamp
+		}
+		if next.status != 0 {
+			if next.retryAfter != "" {
+				w.Header().Set("Retry-After", next.retryAfter)
+			}
+			w.WriteHeader(next.status)
+			fmt.Fprint(w, next.body)
+			return
+		}
+	}
+	ml.mu.Lock()
+	ml.chains = append(ml.chains, c.certs)
+	ml.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(signSCT(ml.t, ml.key, c, timestamp))
+}
+
+// parseRequest checks r is an add-chain (or add-pre-chain) request as RFC 6962
+// section 4.1 describes, with a chain of parseable certs, and returns it
+func (ml *mockLog) parseRequest(r *http.Request) (chain, error) {
+	var c chain
+	if r.Method != http.MethodPost {
+		return c, fmt.Errorf("method %s, want POST", r.Method)
+	}
+	if r.URL.Path != addChainPath && r.URL.Path != addPreChainPath {
+		return c, fmt.Errorf("unexpected path %q", r.URL.Path)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		return c, fmt.Errorf("Content-Type %q, want application/json", ct)
+	}
+	if accept := r.Header.Get("Accept"); accept != "" && !strings.Contains(accept, "application/json") {
+		return c, fmt.Errorf("Accept %q doesn't allow application/json", accept)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return c, err
+	}
+	var req struct {
+		Chain [][]byte `json:"chain"`
+	}
+	d := json.NewDecoder(strings.NewReader(string(body)))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&req); err != nil {
+		return c, fmt.Errorf("malformed body %q: %s", body, err)
+	}
+	if len(req.Chain) == 0 {
+		return c, fmt.Errorf("empty chain in %q", body)
+	}
+	for i, der := range req.Chain {
+		if _, err := x509.ParseCertificate(der); err != nil {
+			return c, fmt.Errorf("chain[%d] doesn't parse: %s", i, err)
+		}
+	}
+	c.certs = req.Chain
+	c.setEndpoint()
+	if c.endpoint != r.URL.Path {
+		return c, fmt.Errorf("chain sent to %s, should have been %s", r.URL.Path, c.endpoint)
+	}
+	return c, nil
+}
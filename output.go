@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rejects is nil unless -rejectLog is set
+var rejects *rejectLog
+
+// rejectLog records chains logs permanently rejected, one tab separated line
+// per rejection: hex chain fingerprint, chain ID, log URL, status code, and
+// the quoted response body
+type rejectLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openRejectLog(path string) (*rejectLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &rejectLog{f: f}, nil
+}
+
+func (rl *rejectLog) record(c chain, logURL string, re rejectedError) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	_, err := fmt.Fprintf(rl.f, "%s\t%d\t%s\t%d\t%s\n", hex.EncodeToString(c.Fingerprint), c.ID, logURL, re.status, strconv.Quote(string(re.body)))
+	if err != nil {
+		slog.Error("failed to write reject log", "err", err)
+	}
+}
+
+func (rl *rejectLog) close() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.f.Close()
+}
+
+// results is nil unless -jsonOutput is set
+var results *resultWriter
+
+type submissionResult struct {
+	ChainID      int64  `json:"chain_id"`
+	ChainFP      string `json:"chain_fp"`
+	LogURL       string `json:"log_url"`
+	SCTTimestamp int64  `json:"sct_timestamp,omitempty"`
+	Status       string `json:"status"`
+}
+
+// resultWriter writes one JSON object per line for each finished submission,
+// the mutex keeps lines from concurrent workers from interleaving
+type resultWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openResultWriter writes to stdout if path is "-"
+func openResultWriter(path string) (*resultWriter, error) {
+	if path == "-" {
+		return &resultWriter{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{w: f}, nil
+}
+
+func (rw *resultWriter) write(c chain, logURL string, ctr *ctResponse, status string) {
+	if rw == nil {
+		return
+	}
+	r := submissionResult{
+		ChainID: c.ID,
+		ChainFP: hex.EncodeToString(c.Fingerprint),
+		LogURL:  logURL,
+		Status:  status,
+	}
+	if ctr != nil {
+		r.SCTTimestamp = ctr.Timestamp
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("failed to marshal result", "chain_id", c.ID, "err", err)
+		return
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	_, err = rw.w.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("failed to write result", "err", err)
+	}
+}
+
+func (rw *resultWriter) close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.w == os.Stdout {
+		return nil
+	}
+	return rw.w.Close()
+}
+
+// csvResults is nil unless -csvOutput is set
+var csvResults *csvWriter
+
+var csvHeader = []string{"chain_id", "chain_fp", "leaf_serial", "leaf_subject", "sct_timestamp", "log_url", "status"}
+
+// csvWriter appends one row per finished submission, the header is only
+// written when the file is new
+type csvWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+func openCSVWriter(path string) (*csvWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cw := &csvWriter{f: f, w: csv.NewWriter(f)}
+	if fi.Size() == 0 {
+		cw.w.Write(csvHeader)
+		cw.w.Flush()
+		if err := cw.w.Error(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return cw, nil
+}
+
+// write leaves the leaf columns blank if the leaf can't be parsed
+func (cw *csvWriter) write(c chain, logURL string, ctr *ctResponse, status string) {
+	if cw == nil {
+		return
+	}
+	var serial, subject, timestamp string
+	if leaf, err := x509.ParseCertificate(c.certs[0]); err == nil {
+		serial = leaf.SerialNumber.Text(16)
+		subject = leaf.Subject.String()
+	}
+	if ctr != nil {
+		timestamp = strconv.FormatInt(ctr.Timestamp, 10)
+	}
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.w.Write([]string{
+		strconv.FormatInt(c.ID, 10),
+		hex.EncodeToString(c.Fingerprint),
+		serial,
+		subject,
+		timestamp,
+		logURL,
+		status,
+	})
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		slog.Error("failed to write CSV row", "err", err)
+	}
+}
+
+func (cw *csvWriter) close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.w.Flush()
+	if err := cw.w.Error(); err != nil {
+		cw.f.Close()
+		return err
+	}
+	return cw.f.Close()
+}
+
+// writeResult records a finished submission in every configured output
+func writeResult(c chain, logURL string, ctr *ctResponse, status string) {
+	results.write(c, logURL, ctr, status)
+	csvResults.write(c, logURL, ctr, status)
+}
+
+type savedResponse struct {
+	ChainID int64           `json:"chain_id"`
+	LogURL  string          `json:"log_url"`
+	Request json.RawMessage `json:"request"`
+	Status  int             `json:"status"`
+	Headers http.Header     `json:"headers"`
+	Body    string          `json:"body"`
+}
+
+// saveResponse writes the request and raw response for a submission to
+// dir/<chain ID>-<log host>.json, later attempts overwrite earlier ones
+func saveResponse(dir string, c chain, l *ctLog, reqBody []byte, resp *http.Response, body []byte) {
+	host := l.url
+	if u, err := url.Parse(l.url); err == nil {
+		host = u.Host
+	}
+	host = strings.NewReplacer(":", "_", "/", "_").Replace(host)
+	data, err := json.MarshalIndent(savedResponse{
+		ChainID: c.ID,
+		LogURL:  l.url,
+		Request: reqBody,
+		Status:  resp.StatusCode,
+		Headers: resp.Header,
+		Body:    string(body),
+	}, "", "  ")
+	if err != nil {
+		slog.Error("failed to marshal response", "chain_id", c.ID, "err", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d-%s.json", c.ID, host)), data, 0644)
+	if err != nil {
+		slog.Error("failed to save response", "chain_id", c.ID, "err", err)
+	}
+}
+
+// sctLog is nil unless -sctsFile is set
+var sctLog *sctFile
+
+type sctLine struct {
+	SCT       string `json:"sct"`
+	LogURL    string `json:"log_url"`
+	ChainFP   string `json:"chain_fp"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// sctFile appends a JSON line per SCT, with the SCT in its RFC 6962 section
+// 3.2 serialization, for verifying offline. Writes are buffered and flushed
+// every -sctFlushInterval and on close, a line is only ever written out whole
+// so a crash can lose the buffer but never leaves half a line behind
+type sctFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	closed bool
+	done   chan struct{}
+}
+
+func openSCTFile(path string) (*sctFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sf := &sctFile{f: f, w: bufio.NewWriterSize(f, 64*1024), done: make(chan struct{})}
+	go sf.flushEvery(*sctFlushInterval)
+	return sf, nil
+}
+
+func (sf *sctFile) write(c chain, logURL string, ctr *ctResponse) {
+	if sf == nil {
+		return
+	}
+	raw, err := serializeSCT(ctr)
+	if err != nil {
+		slog.Error("failed to serialize SCT", "chain_id", c.ID, "log", logURL, "err", err)
+		return
+	}
+	line, err := json.Marshal(sctLine{
+		SCT:       base64.StdEncoding.EncodeToString(raw),
+		LogURL:    logURL,
+		ChainFP:   hex.EncodeToString(c.Fingerprint),
+		Timestamp: ctr.Timestamp,
+	})
+	if err != nil {
+		slog.Error("failed to marshal SCT", "chain_id", c.ID, "err", err)
+		return
+	}
+	line = append(line, '\n')
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.closed {
+		return
+	}
+	// flush first rather than letting the writer split the line
+	if sf.w.Available() < len(line) && sf.w.Buffered() > 0 {
+		if err := sf.w.Flush(); err != nil {
+			slog.Error("failed to write SCTs file", "err", err)
+		}
+	}
+	if _, err := sf.w.Write(line); err != nil {
+		slog.Error("failed to write SCTs file", "err", err)
+	}
+}
+
+func (sf *sctFile) flushEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			sf.mu.Lock()
+			if err := sf.w.Flush(); err != nil {
+				slog.Error("failed to write SCTs file", "err", err)
+			}
+			sf.mu.Unlock()
+		case <-sf.done:
+			return
+		}
+	}
+}
+
+func (sf *sctFile) close() error {
+	close(sf.done)
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.closed = true
+	if err := sf.w.Flush(); err != nil {
+		sf.f.Close()
+		return err
+	}
+	return sf.f.Close()
+}
+
+// serializeSCT encodes an add-chain response as a SignedCertificateTimestamp
+// per RFC 6962 section 3.2, the signature in the response is already the
+// encoded digitally-signed struct
+func serializeSCT(ctr *ctResponse) ([]byte, error) {
+	logID, err := base64.StdEncoding.DecodeString(ctr.ID)
+	if err != nil || len(logID) != sha256.Size {
+		return nil, fmt.Errorf("invalid log ID %q", ctr.ID)
+	}
+	extensions, err := base64.StdEncoding.DecodeString(ctr.Extensions)
+	if err != nil || len(extensions) > 0xffff {
+		return nil, fmt.Errorf("invalid extensions %q", ctr.Extensions)
+	}
+	signature, err := base64.StdEncoding.DecodeString(ctr.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	b := new(bytes.Buffer)
+	b.WriteByte(byte(ctr.SCTVersion))
+	b.Write(logID)
+	binary.Write(b, binary.BigEndian, uint64(ctr.Timestamp))
+	binary.Write(b, binary.BigEndian, uint16(len(extensions)))
+	b.Write(extensions)
+	b.Write(signature)
+	return b.Bytes(), nil
+}
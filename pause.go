@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// paused holds the workers back while submissions are paused, with SIGUSR1
+// and SIGUSR2 or POST /pause and /resume on -healthAddr. Nothing else has to
+// stop, once the queues fill up the feed loop and the database readers block
+// on them until submissions resume
+var paused = newPauseGate()
+
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	pg := &pauseGate{resumed: make(chan struct{})}
+	close(pg.resumed)
+	return pg
+}
+
+func (pg *pauseGate) pause() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	select {
+	case <-pg.resumed:
+		pg.resumed = make(chan struct{})
+		slog.Info("submissions paused")
+	default:
+	}
+}
+
+func (pg *pauseGate) resume() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	select {
+	case <-pg.resumed:
+	default:
+		// a long pause isn't a lack of progress
+		atomic.StoreInt64(&lastProgress, time.Now().UnixNano())
+		close(pg.resumed)
+		slog.Info("submissions resumed")
+	}
+}
+
+func (pg *pauseGate) isPaused() bool {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	select {
+	case <-pg.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait blocks while submissions are paused
+func (pg *pauseGate) wait(ctx context.Context) error {
+	pg.mu.Lock()
+	resumed := pg.resumed
+	pg.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pauseHandler serves POST /pause and /resume
+func pauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if pause {
+			paused.pause()
+		} else {
+			paused.resume()
+		}
+		fmt.Fprintf(w, "paused: %t\n", paused.isPaused())
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// handlePauseSignals is a no-op where there's no SIGUSR1/SIGUSR2, the
+// -healthAddr endpoints still work
+func handlePauseSignals(ctx context.Context) {}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses submissions on SIGUSR1 and resumes them on
+// SIGUSR2 until ctx is done
+func handlePauseSignals(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGUSR1 {
+					paused.pause()
+				} else {
+					paused.resume()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+)
+
+// acceptedRoots is the union of the roots accepted by the configured logs,
+// nil unless -prefilterRoots is set
+var acceptedRoots *rootSet
+
+type rootSet struct {
+	fps       map[[sha256.Size]byte]bool
+	bySubject map[string][]*x509.Certificate
+}
+
+func newRootSet() *rootSet {
+	return &rootSet{
+		fps:       make(map[[sha256.Size]byte]bool),
+		bySubject: make(map[string][]*x509.Certificate),
+	}
+}
+
+func (rs *rootSet) add(cert *x509.Certificate) {
+	rs.fps[sha256.Sum256(cert.Raw)] = true
+	rs.bySubject[string(cert.RawSubject)] = append(rs.bySubject[string(cert.RawSubject)], cert)
+}
+
+// accepts reports whether top, the last certificate in an ordered chain, is
+// either an accepted root itself or was issued by one
+func (rs *rootSet) accepts(top *x509.Certificate) bool {
+	if rs.fps[sha256.Sum256(top.Raw)] {
+		return true
+	}
+	for _, root := range rs.bySubject[string(top.RawIssuer)] {
+		if top.CheckSignatureFrom(root) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type getRootsResponse struct {
+	Certificates []string `json:"certificates"`
+}
+
+// fetchRoots builds a rootSet from the get-roots response of every log
+func fetchRoots(c httpClient, logs []*ctLog) (*rootSet, error) {
+	rs := newRootSet()
+	for _, l := range logs {
+		url := l.base + getRootsPath
+		req, err := newGetRequest(url)
+		if err != nil {
+			return nil, err
+		}
+		l.authorize(req)
+		resp, err := c.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading roots from %s: %s", url, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned status %d, body: %s", url, resp.StatusCode, body)
+		}
+		var roots getRootsResponse
+		err = json.Unmarshal(body, &roots)
+		if err != nil {
+			return nil, fmt.Errorf("malformed roots from %s: %s", url, err)
+		}
+		for _, b64 := range roots.Certificates {
+			der, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed root from %s: %s", url, err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				// roots Go can't parse can't be matched against anyway
+				continue
+			}
+			rs.add(cert)
+		}
+	}
+	return rs, nil
+}
+
+// checkRoot skips chains that don't terminate in an accepted root, it's a
+// no-op when -prefilterRoots isn't set. certs must already be ordered
+func checkRoot(certs [][]byte) error {
+	if acceptedRoots == nil {
+		return nil
+	}
+	top, err := x509.ParseCertificate(certs[len(certs)-1])
+	if err != nil {
+		return err
+	}
+	if !acceptedRoots.accepts(top) {
+		atomic.AddInt64(&numUnknownRoot, 1)
+		return filteredError{errors.New("chain doesn't terminate in a root accepted by the logs")}
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/go-gorp/gorp"
+)
+
+// sctRowsPerInsert bounds the size of each INSERT statement, a batch is
+// split into as many statements as it takes inside one transaction
+const sctRowsPerInsert = 100
+
+// sctStore is nil unless -sctOutputTable is set
+var sctStore *sctWriter
+
+type sctRecord struct {
+	ChainFP    []byte `db:"chain_fp" json:"chain_fp"`
+	LogURL     string `db:"log_url" json:"log_url"`
+	SCTVersion int    `db:"sct_version" json:"sct_version"`
+	LogID      string `db:"log_id" json:"log_id"`
+	Timestamp  int64  `db:"timestamp" json:"timestamp"`
+	Extensions string `db:"extensions" json:"extensions"`
+	Signature  string `db:"signature" json:"signature"`
+}
+
+var sctColumns = []string{"chain_fp", "log_url", "sct_version", "log_id", "timestamp", "extensions", "signature"}
+
+func (r *sctRecord) args() []interface{} {
+	return []interface{}{r.ChainFP, r.LogURL, r.SCTVersion, r.LogID, r.Timestamp, r.Extensions, r.Signature}
+}
+
+// sctWriter collects SCTs from the submission workers and inserts them in
+// batches of -sctBatchSize, or whatever has been collected every
+// -sctFlushInterval, so we don't pay a round trip per SCT. Batches that can't
+// be inserted are appended to fallback as JSON lines instead of being lost
+type sctWriter struct {
+	*batcher[*sctRecord]
+	db       *gorp.DbMap
+	table    string
+	fallback string
+}
+
+func newSCTWriter(db *gorp.DbMap, table, fallback string) *sctWriter {
+	if fallback == "" {
+		fallback = table + ".failed.jsonl"
+	}
+	sw := &sctWriter{
+		db:       db,
+		table:    table,
+		fallback: fallback,
+	}
+	sw.batcher = newBatcher(*sctBatchSize, *sctFlushInterval, sw.flush)
+	return sw
+}
+
+func (sw *sctWriter) flush(batch []*sctRecord) {
+	err := sw.insert(batch)
+	if err != nil {
+		slog.Error("failed to insert SCTs, writing them to the fallback file", "count", len(batch), "file", sw.fallback, "err", err)
+		if err := sw.writeFallback(batch); err != nil {
+			slog.Error("failed to write SCTs to the fallback file", "count", len(batch), "file", sw.fallback, "err", err)
+		}
+	}
+}
+
+func (sw *sctWriter) insert(batch []*sctRecord) error {
+	return withReconnect(context.Background(), sw.db, func(ctx context.Context) error {
+		tx, err := sw.db.Begin()
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(batch); start += sctRowsPerInsert {
+			end := start + sctRowsPerInsert
+			if end > len(batch) {
+				end = len(batch)
+			}
+			query, args := sw.insertQuery(batch[start:end])
+			_, err = tx.WithContext(ctx).Exec(rebind(sw.db.Dialect, query), args...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+func (sw *sctWriter) insertQuery(records []*sctRecord) (string, []interface{}) {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?,", len(sctColumns)), ",") + ")"
+	rows := make([]string, len(records))
+	args := make([]interface{}, 0, len(records)*len(sctColumns))
+	for i, r := range records {
+		rows[i] = row
+		args = append(args, r.args()...)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES %s",
+		sw.table,
+		strings.Join(sctColumns, ", "),
+		strings.Join(rows, ", "),
+	)
+	return query + onDuplicateSCT(sw.db.Dialect), args
+}
+
+// onDuplicateSCT makes SCT inserts idempotent, relying on a unique
+// (log_id, chain_fp) constraint on the table, so retried batches and reruns
+// don't store the same SCT twice. -createSchema adds the constraint for
+// sqlite, MySQL and Postgres tables need it added by hand. MySQL has no DO
+// NOTHING so the update is a no-op instead
+func onDuplicateSCT(d gorp.Dialect) string {
+	switch d.(type) {
+	case gorp.PostgresDialect, gorp.SqliteDialect:
+		return " ON CONFLICT (log_id, chain_fp) DO NOTHING"
+	default:
+		return " ON DUPLICATE KEY UPDATE log_id = log_id"
+	}
+}
+
+func (sw *sctWriter) writeFallback(batch []*sctRecord) error {
+	f, err := os.OpenFile(sw.fallback, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range batch {
+		line, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// logKeys is nil unless -logPublicKey is set
+var logKeys keyring
+
+// keyring maps RFC 6962 log IDs (the SHA-256 hash of the log's DER encoded
+// SubjectPublicKeyInfo) to the public key
+type keyring map[[sha256.Size]byte]crypto.PublicKey
+
+// parseLogKeys accepts PEM, base64 encoded DER SPKIs, or paths to files
+// containing either
+func parseLogKeys(values []string) (keyring, error) {
+	kr := make(keyring, len(values))
+	for _, v := range values {
+		der, err := decodeSPKI(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log public key %q: %s", v, err)
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log public key %q: %s", v, err)
+		}
+		kr[sha256.Sum256(der)] = key
+	}
+	return kr, nil
+}
+
+func decodeSPKI(v string) ([]byte, error) {
+	data := []byte(v)
+	if !strings.Contains(v, "-----BEGIN") {
+		if der, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return der, nil
+		}
+		contents, err := ioutil.ReadFile(v)
+		if err != nil {
+			return nil, errors.New("not PEM, base64, or a readable file")
+		}
+		if der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents))); err == nil {
+			return der, nil
+		}
+		data = contents
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return block.Bytes, nil
+}
+
+// Values from RFC 6962 section 3.2 and RFC 5246 section 7.4.1.4.1
+const (
+	sigTypeCertificateTimestamp = 0
+	entryTypeX509               = 0
+	entryTypePrecert            = 1
+
+	hashSHA256 = 4
+	sigRSA     = 1
+	sigECDSA   = 3
+)
+
+var (
+	oidPoison             = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidPrecertSigningCert = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+)
+
+func isPrecert(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidPoison) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidAuthorityKeyID is the id-ce-authorityKeyIdentifier extension
+var oidAuthorityKeyID = asn1.ObjectIdentifier{2, 5, 29, 35}
+
+// errUnverifiable is returned for SCTs whose signed data can't be rebuilt
+// from the chain, these are skipped rather than counted as bad
+var errUnverifiable = errors.New("can't reconstruct the signed entry")
+
+// precertTBS re-encodes a precertificate's TBSCertificate in the form covered
+// by its SCT, without the CT poison extension. If the precertificate was issued
+// by a precertificate signing certificate, finalIssuer is the CA that issued
+// that, and the issuer and any authority key identifier are changed to
+// finalIssuer's as RFC 6962 section 3.2 requires
+func precertTBS(tbs []byte, finalIssuer *x509.Certificate) ([]byte, error) {
+	var outer asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &outer); err != nil {
+		return nil, err
+	}
+	var fields []byte
+	// issuer is the third universal field, after serialNumber and signature
+	universal := 0
+	for rest := outer.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, err
+		}
+		if field.Class == asn1.ClassUniversal {
+			universal++
+			if universal == 3 && finalIssuer != nil {
+				fields = append(fields, finalIssuer.RawSubject...)
+				continue
+			}
+		}
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+		// extensions [3] EXPLICIT SEQUENCE OF Extension
+		var exts asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &exts); err != nil {
+			return nil, err
+		}
+		var kept []byte
+		for extRest := exts.Bytes; len(extRest) > 0; {
+			var ext pkix.Extension
+			var raw asn1.RawValue
+			extRest, err = asn1.Unmarshal(extRest, &raw)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := asn1.Unmarshal(raw.FullBytes, &ext); err != nil {
+				return nil, err
+			}
+			switch {
+			case ext.Id.Equal(oidPoison):
+			case ext.Id.Equal(oidAuthorityKeyID) && finalIssuer != nil:
+				if len(finalIssuer.SubjectKeyId) == 0 {
+					return nil, errUnverifiable
+				}
+				ext.Value, err = asn1.Marshal(struct {
+					ID []byte `asn1:"optional,tag:0"`
+				}{finalIssuer.SubjectKeyId})
+				if err != nil {
+					return nil, err
+				}
+				encoded, err := asn1.Marshal(ext)
+				if err != nil {
+					return nil, err
+				}
+				kept = append(kept, encoded...)
+			default:
+				kept = append(kept, raw.FullBytes...)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		seq, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: kept})
+		if err != nil {
+			return nil, err
+		}
+		tagged, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: seq})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, tagged...)
+	}
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// isPrecertSigningCert reports whether cert is a precertificate signing
+// certificate, a CA certificate used only to issue precertificates
+func isPrecertSigningCert(cert *x509.Certificate) bool {
+	for _, eku := range cert.UnknownExtKeyUsage {
+		if eku.Equal(oidPrecertSigningCert) {
+			return true
+		}
+	}
+	return false
+}
+
+// signedEntry reconstructs the data covered by an SCT signature for a chain,
+// for precertificates this is the issuer key hash and poison-free TBS. The
+// issuer is the CA that will issue the final certificate, which for a
+// precertificate signing certificate is the next cert in the chain
+func signedEntry(c chain, ctr ctResponse, extensions []byte) ([]byte, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte(byte(ctr.SCTVersion))
+	b.WriteByte(sigTypeCertificateTimestamp)
+	binary.Write(b, binary.BigEndian, uint64(ctr.Timestamp))
+	entry := c.certs[0]
+	if c.endpoint == addPreChainPath {
+		if len(c.certs) < 2 {
+			return nil, errors.New("precertificate without issuer")
+		}
+		leaf, err := x509.ParseCertificate(c.certs[0])
+		if err != nil {
+			return nil, err
+		}
+		issuer, err := x509.ParseCertificate(c.certs[1])
+		if err != nil {
+			return nil, err
+		}
+		var finalIssuer *x509.Certificate
+		if isPrecertSigningCert(issuer) {
+			if len(c.certs) < 3 {
+				return nil, errUnverifiable
+			}
+			finalIssuer, err = x509.ParseCertificate(c.certs[2])
+			if err != nil {
+				return nil, err
+			}
+			issuer = finalIssuer
+		}
+		entry, err = precertTBS(leaf.RawTBSCertificate, finalIssuer)
+		if err != nil {
+			return nil, err
+		}
+		binary.Write(b, binary.BigEndian, uint16(entryTypePrecert))
+		keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		b.Write(keyHash[:])
+	} else {
+		binary.Write(b, binary.BigEndian, uint16(entryTypeX509))
+	}
+	b.Write([]byte{byte(len(entry) >> 16), byte(len(entry) >> 8), byte(len(entry))})
+	b.Write(entry)
+	binary.Write(b, binary.BigEndian, uint16(len(extensions)))
+	b.Write(extensions)
+	return b.Bytes(), nil
+}
+
+func (kr keyring) verify(c chain, ctr ctResponse) error {
+	logID, err := base64.StdEncoding.DecodeString(ctr.ID)
+	if err != nil || len(logID) != sha256.Size {
+		return errors.New("malformed log ID")
+	}
+	var id [sha256.Size]byte
+	copy(id[:], logID)
+	key, present := kr[id]
+	if !present {
+		return fmt.Errorf("no key configured for log ID %s", ctr.ID)
+	}
+	extensions, err := base64.StdEncoding.DecodeString(ctr.Extensions)
+	if err != nil {
+		return errors.New("malformed extensions")
+	}
+	ds, err := base64.StdEncoding.DecodeString(ctr.Signature)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	// digitally-signed struct: hash algorithm, signature algorithm, and a
+	// uint16 length prefixed signature
+	if len(ds) < 4 || int(binary.BigEndian.Uint16(ds[2:4])) != len(ds)-4 {
+		return errors.New("malformed signature")
+	}
+	if ds[0] != hashSHA256 {
+		return fmt.Errorf("unsupported hash algorithm %d", ds[0])
+	}
+	signed, err := signedEntry(c, ctr, extensions)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(signed)
+	sig := ds[4:]
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if ds[1] != sigECDSA || !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if ds[1] != sigRSA || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
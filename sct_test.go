@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// signSCT returns the add-chain response a log holding key would give for c
+func signSCT(t testing.TB, key *ecdsa.PrivateKey, c chain, timestamp int64) ctResponse {
+	t.Helper()
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := sha256.Sum256(spki)
+	ctr := ctResponse{ID: base64.StdEncoding.EncodeToString(logID[:]), Timestamp: timestamp}
+	signed, err := signedEntry(c, ctr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := append([]byte{hashSHA256, sigECDSA, byte(len(sig) >> 8), byte(len(sig))}, sig...)
+	ctr.Signature = base64.StdEncoding.EncodeToString(ds)
+	return ctr
+}
+
+func testKeyring(t testing.TB, key *ecdsa.PrivateKey) keyring {
+	t.Helper()
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := parseLogKeys([]string{base64.StdEncoding.EncodeToString(spki)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kr
+}
+
+var poison = pkix.Extension{Id: oidPoison, Critical: true, Value: asn1.NullBytes}
+
+// precerts issues the same precertificate twice, directly from a CA and from
+// a precertificate signing certificate the CA issued, and returns both chains
+func precerts(t *testing.T) (direct, viaSigner chain) {
+	root := issue(t, caTemplate("test root"), nil)
+	signerTmpl := caTemplate("test precert signer")
+	signerTmpl.UnknownExtKeyUsage = []asn1.ObjectIdentifier{oidPrecertSigningCert}
+	signer := issue(t, signerTmpl, root)
+	key := newTestKey(t)
+	tmpl := leafTemplate("precert.example.com")
+	tmpl.ExtraExtensions = []pkix.Extension{poison}
+	fromRoot := issueKey(t, tmpl, root, key)
+	fromSigner := issueKey(t, tmpl, signer, key)
+	direct = chain{certs: [][]byte{fromRoot.der, root.der}}
+	viaSigner = chain{certs: [][]byte{fromSigner.der, signer.der, root.der}}
+	direct.setEndpoint()
+	viaSigner.setEndpoint()
+	return direct, viaSigner
+}
+
+func TestSignedEntryPrecertSigningCert(t *testing.T) {
+	direct, viaSigner := precerts(t)
+	if direct.endpoint != addPreChainPath || viaSigner.endpoint != addPreChainPath {
+		t.Fatalf("precertificates weren't sent to %s", addPreChainPath)
+	}
+	ctr := ctResponse{Timestamp: time.Now().UnixMilli()}
+	want, err := signedEntry(direct, ctr, nil)
+	if err != nil {
+		t.Fatalf("signedEntry failed for a directly issued precertificate: %s", err)
+	}
+	// the issuer, authority key ID and issuer key hash are all the root's,
+	// so the signed data matches the directly issued precertificate's
+	got, err := signedEntry(viaSigner, ctr, nil)
+	if err != nil {
+		t.Fatalf("signedEntry failed for a precertificate signing certificate: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("signed entry for a precertificate signing certificate chain doesn't match the directly issued precertificate's")
+	}
+	viaSigner.certs = viaSigner.certs[:2]
+	if _, err := signedEntry(viaSigner, ctr, nil); err != errUnverifiable {
+		t.Errorf("signedEntry without the final issuer = %v, want errUnverifiable", err)
+	}
+}
+
+func TestKeyringVerify(t *testing.T) {
+	logKey := newTestKey(t)
+	kr := testKeyring(t, logKey)
+	certs, _ := testChain(t)
+	final := chain{certs: certs}
+	final.setEndpoint()
+	direct, viaSigner := precerts(t)
+	now := time.Now().UnixMilli()
+	for name, c := range map[string]chain{"certificate": final, "precertificate": direct, "precertificate signing certificate": viaSigner} {
+		ctr := signSCT(t, logKey, c, now)
+		if err := kr.verify(c, ctr); err != nil {
+			t.Errorf("%s: verify failed: %s", name, err)
+		}
+		ctr.Timestamp++
+		if err := kr.verify(c, ctr); err == nil {
+			t.Errorf("%s: verify passed with the wrong timestamp", name)
+		}
+	}
+	ctr := signSCT(t, logKey, final, now)
+	if err := testKeyring(t, newTestKey(t)).verify(final, ctr); err == nil {
+		t.Error("verify passed for a log ID with no key configured")
+	}
+}
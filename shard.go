@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// shardWindow is the [start, end) range of leaf NotAfter times a temporally
+// sharded log accepts, a zero bound is open
+type shardWindow struct {
+	start, end time.Time
+}
+
+func (sw *shardWindow) contains(t time.Time) bool {
+	return (sw.start.IsZero() || !t.Before(sw.start)) && (sw.end.IsZero() || t.Before(sw.end))
+}
+
+// parseLogShard parses a -logShard entry, <logURL>=<start>,<end> with both
+// bounds in RFC 3339 and either one allowed to be empty
+func parseLogShard(entry string) (string, *shardWindow, error) {
+	i := strings.LastIndex(entry, "=")
+	if i <= 0 {
+		return "", nil, fmt.Errorf("invalid -logShard entry %q, must be <logURL>=<start>,<end>", entry)
+	}
+	bounds := strings.Split(entry[i+1:], ",")
+	if len(bounds) != 2 {
+		return "", nil, fmt.Errorf("invalid -logShard entry %q, must be <logURL>=<start>,<end>", entry)
+	}
+	sw := new(shardWindow)
+	for j, dst := range []*time.Time{&sw.start, &sw.end} {
+		if bounds[j] == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bounds[j])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid -logShard entry %q: %s", entry, err)
+		}
+		*dst = t
+	}
+	if !sw.start.IsZero() && !sw.end.IsZero() && !sw.start.Before(sw.end) {
+		return "", nil, fmt.Errorf("invalid -logShard entry %q, start must be before end", entry)
+	}
+	return entry[:i], sw, nil
+}
+
+// routeChain returns the indexes of the logs c should be submitted to, logs
+// without a shard get every chain and sharded logs only get chains whose leaf
+// NotAfter is in their window. A leaf that can't be parsed only goes to the
+// unsharded logs
+func routeChain(c chain, logs []*ctLog) []int {
+	targets := make([]int, 0, len(logs))
+	sharded := false
+	for i, l := range logs {
+		if l.shard == nil {
+			targets = append(targets, i)
+		} else {
+			sharded = true
+		}
+	}
+	if !sharded {
+		return targets
+	}
+	leaf, err := x509.ParseCertificate(c.certs[0])
+	if err != nil {
+		return targets
+	}
+	for i, l := range logs {
+		if l.shard != nil && l.shard.contains(leaf.NotAfter) {
+			targets = append(targets, i)
+		}
+	}
+	return targets
+}
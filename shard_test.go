@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestParseLogShard(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		entry      string
+		url        string
+		start, end time.Time
+		err        bool
+	}{
+		{entry: "https://log/ct/v1/add-chain=2024-01-01T00:00:00Z,2025-01-01T00:00:00Z", url: "https://log/ct/v1/add-chain", start: start, end: end},
+		{entry: "https://log?a=b=2024-01-01T00:00:00Z,", url: "https://log?a=b", start: start},
+		{entry: "https://log=,2025-01-01T00:00:00Z", url: "https://log", end: end},
+		{entry: "https://log=2025-01-01T00:00:00Z,2024-01-01T00:00:00Z", err: true},
+		{entry: "https://log=2024-01-01T00:00:00Z", err: true},
+		{entry: "https://log=2024-01-01,2025-01-01", err: true},
+		{entry: "=2024-01-01T00:00:00Z,", err: true},
+	} {
+		url, sw, err := parseLogShard(tc.entry)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseLogShard(%q) didn't fail", tc.entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLogShard(%q) failed: %s", tc.entry, err)
+			continue
+		}
+		if url != tc.url || !sw.start.Equal(tc.start) || !sw.end.Equal(tc.end) {
+			t.Errorf("parseLogShard(%q) = %q, [%s, %s), want %q, [%s, %s)", tc.entry, url, sw.start, sw.end, tc.url, tc.start, tc.end)
+		}
+	}
+}
+
+func TestLogShardFlag(t *testing.T) {
+	var shards entryList
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&shards, "logShard", "")
+	err := fs.Parse([]string{
+		"-logShard", "https://a=2024-01-01T00:00:00Z,2025-01-01T00:00:00Z",
+		"-logShard", "https://b=2025-01-01T00:00:00Z,",
+	})
+	if err != nil {
+		t.Fatalf("flag parsing failed: %s", err)
+	}
+	if len(shards) != 2 {
+		t.Fatalf("got %d -logShard entries, want 2: %q", len(shards), shards)
+	}
+	for _, entry := range shards {
+		if _, _, err := parseLogShard(entry); err != nil {
+			t.Errorf("parseLogShard(%q) failed: %s", entry, err)
+		}
+	}
+}
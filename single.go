@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-gorp/gorp"
+)
+
+// tracingClient prints every request body and response it sees to w
+type tracingClient struct {
+	httpClient
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (tc *tracingClient) Do(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+	}
+	resp, err := tc.httpClient.Do(req)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	fmt.Fprintf(tc.w, "> %s %s\n", req.Method, req.URL)
+	if req.Header.Get("Content-Encoding") == "" {
+		fmt.Fprintf(tc.w, "%s\n", reqBody)
+	} else {
+		fmt.Fprintf(tc.w, "(%d bytes, %s encoded)\n", len(reqBody), req.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		fmt.Fprintf(tc.w, "< error: %s\n", err)
+		return nil, err
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fmt.Fprintf(tc.w, "< %s\n", resp.Status)
+	for name, values := range resp.Header {
+		for _, v := range values {
+			fmt.Fprintf(tc.w, "< %s: %s\n", name, v)
+		}
+	}
+	fmt.Fprintf(tc.w, "%s\n", body)
+	if readErr != nil {
+		fmt.Fprintf(tc.w, "< error reading body: %s\n", readErr)
+	}
+	return resp, nil
+}
+
+// submitSingleChain submits the chain with fingerprint fp to every log,
+// printing the requests and responses, and fails if any log doesn't accept
+// it
+func submitSingleChain(ctx context.Context, db *gorp.DbMap, c httpClient, logs []*ctLog, fp string) error {
+	rawFP, err := hex.DecodeString(fp)
+	if err != nil {
+		return exitError{exitConfig, fmt.Errorf("invalid -chainFP: %s", err)}
+	}
+	var single chain
+	err = withReconnect(ctx, db, func(ctx context.Context) error {
+		return db.WithContext(ctx).SelectOne(&single, rebind(db.Dialect, tableQuery(selectChainByFP)), rawFP)
+	})
+	if err != nil {
+		return exitError{exitDB, fmt.Errorf("failed to look up chain %s: %s", fp, err)}
+	}
+	err = getCerts(ctx, db, &single)
+	if err != nil {
+		return exitError{exitDB, fmt.Errorf("failed to assemble chain %d: %s", single.ID, err)}
+	}
+	tc := &tracingClient{httpClient: c, w: os.Stdout}
+	submission := &pendingChain{chain: single, remaining: int32(len(logs))}
+	failed := 0
+	for _, l := range logs {
+		_, err := submitWithRetry(ctx, tc, l, submission)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "# [%s did not accept chain %d: %s]\n", l.url, single.ID, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "# [%s accepted chain %d]\n", l.url, single.ID)
+	}
+	if failed > 0 {
+		return exitError{exitRejected, fmt.Errorf("chain %d was not accepted by %d of %d logs", single.ID, failed, len(logs))}
+	}
+	return nil
+}
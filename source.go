@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gorp/gorp"
+)
+
+// chainSource yields batches of chains with their certs populated, in
+// ascending ID order, and returns io.EOF once it is exhausted
+type chainSource interface {
+	Next() ([]chain, error)
+}
+
+// dbSource pages through the chains table and assembles each chain from the
+// reports and certs tables
+type dbSource struct {
+	ctx     context.Context
+	db      *gorp.DbMap
+	pages   chan []chain
+	readErr chan error
+}
+
+func newDBSource(ctx context.Context, db *gorp.DbMap) *dbSource {
+	ds := &dbSource{
+		ctx:     ctx,
+		db:      db,
+		pages:   make(chan []chain, 100),
+		readErr: make(chan error, 1),
+	}
+	go func() {
+		ds.readErr <- getChains(ctx, db, ds.pages)
+		close(ds.pages)
+	}()
+	return ds
+}
+
+func (ds *dbSource) Next() ([]chain, error) {
+	page, ok := <-ds.pages
+	if !ok {
+		// cancellation is a clean stop, not a failure
+		if err := <-ds.readErr; err != nil && !errors.Is(err, context.Canceled) {
+			return nil, exitError{exitDB, fmt.Errorf("failed to read chains: %s", err)}
+		}
+		return nil, io.EOF
+	}
+	return fetchCerts(ds.ctx, ds.db, page)
+}
+
+// fetchCerts runs getCerts for every chain in page that -sampleEvery keeps on
+// -certFetchers goroutines and drops the chains it fails for. The chains come
+// back in page order, which the progress watermark relies on
+func fetchCerts(ctx context.Context, db *gorp.DbMap, page []chain) ([]chain, error) {
+	sampled := page[:0]
+	for _, partialChain := range page {
+		if !sampledOut(partialChain.ID) {
+			sampled = append(sampled, partialChain)
+		}
+	}
+	page = sampled
+	if lazy != nil {
+		// the workers fetch them instead
+		return page, nil
+	}
+	fetchers := *certFetchers
+	if fetchers < 1 {
+		fetchers = 1
+	}
+	errs := make([]error, len(page))
+	next := int64(-1)
+	wg := new(sync.WaitGroup)
+	for f := 0; f < fetchers; f++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(page) {
+					return
+				}
+				if ctx.Err() != nil {
+					errs[i] = ctx.Err()
+					continue
+				}
+				errs[i] = getCerts(ctx, db, &page[i])
+			}
+		}()
+	}
+	wg.Wait()
+	chains := page[:0]
+	for i, partialChain := range page {
+		err := errs[i]
+		if (err == errMultiLeaf && *onMultiLeaf == "error") || (err == errNoLeaf && *noLeafPolicy == "error") {
+			return nil, exitError{exitPipeline, fmt.Errorf("chain %d: %s", partialChain.ID, err)}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(fetchError); ok {
+				progress.hold(partialChain.ID)
+			}
+			logSkip(partialChain.ID, err)
+			continue // skip broken chains
+		}
+		chains = append(chains, partialChain)
+	}
+	return chains, nil
+}
+
+// sampledOut reports whether -sampleEvery skips chain id, the decision only
+// needs the ID so the sources make it before fetching or parsing any certs
+func sampledOut(id int64) bool {
+	if *sampleEvery > 1 && id%*sampleEvery != 0 {
+		atomic.AddInt64(&numSampledOut, 1)
+		atomic.AddInt64(&numResolved, 1)
+		return true
+	}
+	return false
+}
+
+// readAhead is how many pages each of the -dbReaders may read ahead of the
+// chains being submitted
+const readAhead = 100
+
+// getChains reads pages of chains after -initialChainID. With more than one
+// of -dbReaders the IDs up to the last chain are split into contiguous ranges,
+// one per reader, and the readers' pages are passed on a range at a time so
+// chainCh sees every chain exactly once and in ascending ID order. It stops
+// between pages and sends once ctx is done, returning ctx.Err()
+func getChains(ctx context.Context, db *gorp.DbMap, chainCh chan []chain) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	bounds, err := readerRanges(ctx, db, *initialChainID, lastChainID, *dbReaders)
+	if err != nil {
+		return err
+	}
+	readers := len(bounds) - 1
+	pages := make([]chan []chain, readers)
+	errs := make([]error, readers)
+	for i := range pages {
+		pages[i] = make(chan []chain, readAhead)
+		go func(i int) {
+			defer close(pages[i])
+			errs[i] = readPages(ctx, db, bounds[i], bounds[i+1], pages[i])
+		}(i)
+	}
+	for i := range pages {
+		for page := range pages[i] {
+			select {
+			case chainCh <- page:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+	return nil
+}
+
+// readerRanges splits the chain IDs in (from, to] into contiguous ranges for
+// readers, reader i reads (bounds[i], bounds[i+1]]. Without a snapshot to is
+// unbounded, so the split is over the IDs there are now and the last reader
+// also reads any chains added during the run
+func readerRanges(ctx context.Context, db *gorp.DbMap, from, to int64, readers int) ([]int64, error) {
+	if readers <= 1 {
+		return []int64{from, to}, nil
+	}
+	last := to
+	if last == math.MaxInt64 {
+		err := withReconnect(ctx, db, func(ctx context.Context) error {
+			var err error
+			last, err = db.WithContext(ctx).SelectInt(tableQuery(selectMaxChainID))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	span := last - from
+	if span < int64(readers) {
+		return []int64{from, to}, nil
+	}
+	bounds := make([]int64, readers+1)
+	for i := range bounds {
+		bounds[i] = from + span/int64(readers)*int64(i) + span%int64(readers)*int64(i)/int64(readers)
+	}
+	bounds[readers] = to
+	return bounds, nil
+}
+
+// lastChainID is the highest chain ID read, the snapshot taken at startup
+// unless -noSnapshot is set
+var lastChainID int64 = math.MaxInt64
+
+// readPages reads pages of the chains in (cursor, last], keyset style so
+// every page costs the same no matter how far into the table it is
+func readPages(ctx context.Context, db *gorp.DbMap, cursor, last int64, pageCh chan []chain) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var chains []chain
+		err := withReconnect(ctx, db, func(ctx context.Context) error {
+			_, err := db.WithContext(ctx).Select(&chains, rebind(db.Dialect, tableQuery(unsubmittedOnly(selectChains))), cursor, last, maxChains)
+			return err
+		})
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		atomic.AddInt64(&numChainsRead, int64(len(chains)))
+		if len(chains) > 0 {
+			select {
+			case pageCh <- chains:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if len(chains) < maxChains {
+			return nil
+		}
+		cursor = chains[len(chains)-1].ID
+	}
+}
+
+// resubmitSource reads the chains listed in a file, one chain fingerprint (in
+// hex) or chain ID per line. Only the first field of each line is used, so a
+// -rejectLog file can be fed straight back in
+type resubmitSource struct {
+	ctx    context.Context
+	db     *gorp.DbMap
+	chains []chain
+}
+
+func newResubmitSource(ctx context.Context, db *gorp.DbMap, path string) (*resubmitSource, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fps, ids []interface{}
+	for i, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fp, err := hex.DecodeString(fields[0]); err == nil && len(fp) == sha256.Size {
+			fps = append(fps, fp)
+		} else if id, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			ids = append(ids, id)
+		} else {
+			return nil, fmt.Errorf("%s:%d: %q is neither a chain fingerprint nor a chain ID", path, i+1, fields[0])
+		}
+	}
+	rs := &resubmitSource{ctx: ctx, db: db}
+	for _, lookup := range []struct {
+		query string
+		keys  []interface{}
+	}{{selectChainsByFP, fps}, {selectChainsByID, ids}} {
+		for len(lookup.keys) > 0 {
+			n := len(lookup.keys)
+			if n > maxChains {
+				n = maxChains
+			}
+			placeholders := strings.TrimSuffix(strings.Repeat("?,", n), ",")
+			var chains []chain
+			err := withReconnect(ctx, db, func(ctx context.Context) error {
+				_, err := db.WithContext(ctx).Select(&chains, rebind(db.Dialect, tableQuery(fmt.Sprintf(lookup.query, placeholders))), lookup.keys[:n]...)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&numChainsRead, int64(len(chains)))
+			rs.chains = append(rs.chains, chains...)
+			lookup.keys = lookup.keys[n:]
+		}
+	}
+	// chains have to come out in ascending ID order, and listing a chain by
+	// both fingerprint and ID shouldn't submit it twice
+	sort.Slice(rs.chains, func(i, j int) bool { return rs.chains[i].ID < rs.chains[j].ID })
+	unique := rs.chains[:0]
+	for _, c := range rs.chains {
+		if len(unique) == 0 || unique[len(unique)-1].ID != c.ID {
+			unique = append(unique, c)
+		}
+	}
+	rs.chains = unique
+	return rs, nil
+}
+
+func (rs *resubmitSource) Next() ([]chain, error) {
+	if len(rs.chains) == 0 {
+		return nil, io.EOF
+	}
+	n := len(rs.chains)
+	if n > maxChains {
+		n = maxChains
+	}
+	page := rs.chains[:n]
+	rs.chains = rs.chains[n:]
+	return fetchCerts(rs.ctx, rs.db, page)
+}
+
+type report struct {
+	CertFP    string `db:"cert_fp"`
+	EndEntity bool   `db:"is_end_entity"`
+}
+
+type rawCert struct {
+	CertFP string `db:"cert_fp"`
+	Raw    []byte `db:"raw_cert"`
+}
+
+var errNoLeaf = errors.New("chain without end-entity")
+
+func getCerts(ctx context.Context, db *gorp.DbMap, partialChain *chain) error {
+	var reports []report
+	err := withReconnect(ctx, db, func(ctx context.Context) error {
+		_, err := db.WithContext(ctx).Select(&reports, rebind(db.Dialect, tableQuery(selectReports)), partialChain.Fingerprint)
+		return err
+	})
+	if err != nil {
+		atomic.AddInt64(&numSkippedCertFetch, 1)
+		return fetchError{err}
+	}
+	if len(reports) == 0 {
+		atomic.AddInt64(&numSkippedNoLeaf, 1)
+		return errNoLeaf
+	}
+	byFP, err := loadRawCerts(ctx, db, reports)
+	if err != nil {
+		atomic.AddInt64(&numSkippedCertFetch, 1)
+		return fetchError{err}
+	}
+	certs, err := assembleCerts(reports, byFP)
+	if dangling, ok := err.(danglingCertError); ok {
+		atomic.AddInt64(&numDanglingCert, 1)
+		return fmt.Errorf("chain_fp %x: %s", partialChain.Fingerprint, dangling)
+	}
+	switch err {
+	case nil:
+	case errNoLeaf:
+		atomic.AddInt64(&numSkippedNoLeaf, 1)
+		return err
+	default:
+		return err
+	}
+	certs, err = filterChain(partialChain.ID, certs)
+	if err != nil {
+		return err
+	}
+	partialChain.certs = certs
+	partialChain.setEndpoint()
+	return nil
+}
+
+// filterChain runs the checks and clean ups every source applies to a chain
+// once its certs are loaded, and returns the certs as they should be
+// submitted
+func filterChain(id int64, certs [][]byte) ([][]byte, error) {
+	if err := validateDER(certs); err != nil {
+		return nil, err
+	}
+	if isSelfSignedCA(certs[0]) {
+		atomic.AddInt64(&numSelfSignedLeaf, 1)
+		return nil, errors.New("end-entity is a self-signed CA certificate")
+	}
+	if err := checkLeaf(certs[0], time.Now()); err != nil {
+		return nil, err
+	}
+	certs = excludeCerts(id, dedupeCerts(certs))
+	if err := checkIntermediate(certs); err != nil {
+		return nil, err
+	}
+	if size := chainBytes(certs); *maxChainBytes > 0 && size > *maxChainBytes {
+		atomic.AddInt64(&numOversized, 1)
+		return nil, fmt.Errorf("chain %d is %d bytes, over -maxChainBytes", id, size)
+	}
+	certs, err := orderChain(certs)
+	if err != nil {
+		atomic.AddInt64(&numUnorderable, 1)
+		return nil, err
+	}
+	if err := checkRoot(certs); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// fetchError is a failure to read a chain's certs from the database, unlike
+// the chains skipped for their contents it may well work on a later run, so
+// the chain holds the progress watermark
+type fetchError struct {
+	error
+}
+
+var errMultiLeaf = errors.New("chain with multiple end-entities")
+
+// danglingCertError is returned for a report whose cert_fp has no row in the
+// certs table
+type danglingCertError struct {
+	certFP string
+}
+
+func (de danglingCertError) Error() string {
+	return fmt.Sprintf("reported cert_fp %s is missing from the certs table", de.certFP)
+}
+
+// assembleCerts orders the raw certs for a chain's reports with the
+// end-entity first, followed by the others in report order. Chains with more
+// than one end-entity are handled according to -onMultiLeaf, with "first"
+// the extra end-entities are dropped rather than treated as intermediates.
+// Chains without one are handled according to -noLeafPolicy, with
+// "submitFirst" the cert with the lexically first fingerprint is used as the
+// leaf
+func assembleCerts(reports []report, byFP map[string][]byte) ([][]byte, error) {
+	var leaf []byte
+	var others [][]byte
+	multiLeaf := false
+	for _, r := range reports {
+		raw, present := byFP[r.CertFP]
+		if !present {
+			return nil, danglingCertError{r.CertFP}
+		}
+		if !r.EndEntity {
+			others = append(others, raw)
+		} else if leaf != nil {
+			multiLeaf = true
+		} else {
+			leaf = raw
+		}
+	}
+	if leaf == nil {
+		if *noLeafPolicy != "submitFirst" || len(others) == 0 {
+			return nil, errNoLeaf
+		}
+		first := 0
+		for i, r := range reports {
+			if r.CertFP < reports[first].CertFP {
+				first = i
+			}
+		}
+		atomic.AddInt64(&numNoLeafFirst, 1)
+		leaf = others[first]
+		others = append(others[:first:first], others[first+1:]...)
+	}
+	if multiLeaf {
+		atomic.AddInt64(&numMultiLeaf, 1)
+		if *onMultiLeaf != "first" {
+			return nil, errMultiLeaf
+		}
+	}
+	return append([][]byte{leaf}, others...), nil
+}
+
+// validateDER makes sure every cert parses when -validateDER is set, so
+// corrupted raw certs are caught here instead of by the log
+func validateDER(certs [][]byte) error {
+	if !*validateCertDER {
+		return nil
+	}
+	for i, der := range certs {
+		if _, err := x509.ParseCertificate(der); err != nil {
+			atomic.AddInt64(&numInvalidDER, 1)
+			return fmt.Errorf("cert %d of the chain doesn't parse: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// checkIntermediate skips leaf-only chains when -requireIntermediate is set,
+// logs that need the full chain would only reject them
+func checkIntermediate(certs [][]byte) error {
+	if *requireIntermediate && len(certs) < 2 {
+		atomic.AddInt64(&numNoIntermediate, 1)
+		return errors.New("chain has no intermediates")
+	}
+	return nil
+}
+
+// isSelfSignedCA catches roots that reports wrongly flags as the end-entity,
+// leaves Go can't parse are left for the log to deal with
+func isSelfSignedCA(der []byte) bool {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return false
+	}
+	return cert.IsCA && bytes.Equal(cert.RawIssuer, cert.RawSubject)
+}
+
+// filteredError is returned for chains skipped on purpose by a filter flag,
+// rather than because something is wrong with them
+type filteredError struct {
+	error
+}
+
+// logSkip logs why a chain was dropped before submission and counts it as
+// resolved, filtered chains are only logged at debug level since they are
+// expected
+func logSkip(id int64, err error) {
+	atomic.AddInt64(&numResolved, 1)
+	if _, ok := err.(filteredError); ok {
+		slog.Debug("skipping chain", "chain_id", id, "err", err)
+		return
+	}
+	slog.Warn("skipping chain", "chain_id", id, "err", err)
+}
+
+// checkLeaf applies the -skipExpired, -minNotAfter/-maxNotAfter,
+// -minNotBefore/-maxNotBefore, and -filterIssuerCN/-filterSANSuffix filters
+// to the leaf, it's a no-op (and the leaf isn't parsed) when none are set
+func checkLeaf(der []byte, now time.Time) error {
+	if !*skipExpired && minNotAfter.IsZero() && maxNotAfter.IsZero() && minNotBefore.IsZero() && maxNotBefore.IsZero() && *filterIssuerCN == "" && *filterSANSuffix == "" {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		atomic.AddInt64(&numUnparseableLeaf, 1)
+		return fmt.Errorf("unparseable leaf: %s", err)
+	}
+	if *skipExpired && leaf.NotAfter.Before(now) {
+		atomic.AddInt64(&numExpiredSkipped, 1)
+		return filteredError{errors.New("leaf has expired")}
+	}
+	if (!minNotAfter.IsZero() && leaf.NotAfter.Before(minNotAfter.Time)) ||
+		(!maxNotAfter.IsZero() && !leaf.NotAfter.Before(maxNotAfter.Time)) {
+		atomic.AddInt64(&numOutOfShard, 1)
+		return filteredError{errors.New("leaf expiry outside of the log's shard")}
+	}
+	if (!minNotBefore.IsZero() && leaf.NotBefore.Before(minNotBefore.Time)) ||
+		(!maxNotBefore.IsZero() && !leaf.NotBefore.Before(maxNotBefore.Time)) {
+		atomic.AddInt64(&numOutsideNotBefore, 1)
+		return filteredError{errors.New("leaf NotBefore outside of -minNotBefore/-maxNotBefore")}
+	}
+	if *filterIssuerCN != "" && leaf.Issuer.CommonName != *filterIssuerCN {
+		atomic.AddInt64(&numFiltered, 1)
+		return filteredError{fmt.Errorf("leaf issuer CN %q doesn't match -filterIssuerCN", leaf.Issuer.CommonName)}
+	}
+	if *filterSANSuffix != "" && !hasSANSuffix(leaf, *filterSANSuffix) {
+		atomic.AddInt64(&numFiltered, 1)
+		return filteredError{errors.New("no leaf SAN matches -filterSANSuffix")}
+	}
+	return nil
+}
+
+func hasSANSuffix(cert *x509.Certificate, suffix string) bool {
+	suffix = strings.ToLower(suffix)
+	for _, name := range cert.DNSNames {
+		if strings.HasSuffix(strings.ToLower(name), suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedCerts is nil unless -excludeFingerprints is set
+var excludedCerts map[[sha256.Size]byte]bool
+
+func parseFingerprints(list []string) (map[[sha256.Size]byte]bool, error) {
+	fps := make(map[[sha256.Size]byte]bool, len(list))
+	for _, s := range list {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%q isn't a SHA-256 hex fingerprint", s)
+		}
+		var fp [sha256.Size]byte
+		copy(fp[:], b)
+		fps[fp] = true
+	}
+	return fps, nil
+}
+
+// excludeCerts drops the intermediates listed in -excludeFingerprints, the
+// leaf is always kept. Whether what's left still makes a valid chain is up to
+// the log
+func excludeCerts(id int64, certs [][]byte) [][]byte {
+	if excludedCerts == nil {
+		return certs
+	}
+	kept := certs[:1]
+	for _, der := range certs[1:] {
+		fp := sha256.Sum256(der)
+		if excludedCerts[fp] {
+			atomic.AddInt64(&numExcludedCerts, 1)
+			slog.Debug("excluding certificate from chain", "chain_id", id, "cert_fp", hex.EncodeToString(fp[:]))
+			continue
+		}
+		kept = append(kept, der)
+	}
+	return kept
+}
+
+func chainBytes(certs [][]byte) int {
+	n := 0
+	for _, der := range certs {
+		n += len(der)
+	}
+	return n
+}
+
+// dedupeCerts drops repeated certificates from a chain, keeping the first
+// occurrence of each so the leaf stays first
+func dedupeCerts(certs [][]byte) [][]byte {
+	seen := make(map[[sha256.Size]byte]bool, len(certs))
+	deduped := certs[:0]
+	for _, der := range certs {
+		fp := sha256.Sum256(der)
+		if seen[fp] {
+			atomic.AddInt64(&numDuplicateCerts, 1)
+			continue
+		}
+		seen[fp] = true
+		deduped = append(deduped, der)
+	}
+	return deduped
+}
+
+// orderChain sorts the intermediates following the leaf so that each
+// certificate is followed by its issuer, matching issuer and subject names
+// and using the authority and subject key identifiers to break ties. Chains
+// containing certificates that don't fit anywhere in the path are rejected,
+// chains with certificates Go can't parse are left as they are and submitted
+// unless -validateDER is set
+func orderChain(certs [][]byte) ([][]byte, error) {
+	parsed := make([]*x509.Certificate, len(certs))
+	for i, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return certs, nil
+		}
+		parsed[i] = cert
+	}
+	ordered := [][]byte{certs[0]}
+	current := parsed[0]
+	remaining := make([]int, 0, len(certs)-1)
+	for i := 1; i < len(certs); i++ {
+		remaining = append(remaining, i)
+	}
+	for len(remaining) > 0 && !bytes.Equal(current.RawSubject, current.RawIssuer) {
+		next := -1
+		for j, idx := range remaining {
+			candidate := parsed[idx]
+			if !bytes.Equal(candidate.RawSubject, current.RawIssuer) {
+				continue
+			}
+			if next == -1 || (len(current.AuthorityKeyId) > 0 && bytes.Equal(candidate.SubjectKeyId, current.AuthorityKeyId)) {
+				next = j
+			}
+		}
+		if next == -1 {
+			break
+		}
+		idx := remaining[next]
+		remaining = append(remaining[:next], remaining[next+1:]...)
+		ordered = append(ordered, certs[idx])
+		current = parsed[idx]
+	}
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("unorderable chain: %d certificates not part of the issuer path", len(remaining))
+	}
+	return ordered, nil
+}
+
+// checkSourceFlags rejects more than one of the flags picking where chains
+// are read from, run would otherwise quietly use whichever it checks first
+func checkSourceFlags() error {
+	var set []string
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"-chainFP", *chainFP != ""},
+		{"-pemFile/-pemDir", *pemFile != "" || *pemDir != ""},
+		{"-sourceLogURL", *sourceLogURL != ""},
+		{"-resubmitFile", *resubmitFile != ""},
+	} {
+		if f.on {
+			set = append(set, f.name)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("%s can't be used together", strings.Join(set, ", "))
+	}
+	return nil
+}
+
+// pemSource reads chains from files of concatenated PEM certificates, a new
+// chain starts at each non-CA certificate and collects the CA certificates
+// that follow it. Chains are numbered sequentially across files (which are
+// read in name order) starting at 1, so -initialChainID and checkpoints work
+// the same way they do for the database
+type pemSource struct {
+	files  []string
+	nextID int64
+}
+
+func newPEMSource(file, dir string) (*pemSource, error) {
+	ps := &pemSource{}
+	if file != "" {
+		ps.files = append(ps.files, file)
+	}
+	if dir != "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, e := range entries {
+			if e.Mode().IsRegular() {
+				names = append(names, filepath.Join(dir, e.Name()))
+			}
+		}
+		sort.Strings(names)
+		ps.files = append(ps.files, names...)
+	}
+	return ps, nil
+}
+
+func (ps *pemSource) Next() ([]chain, error) {
+	if len(ps.files) == 0 {
+		return nil, io.EOF
+	}
+	path := ps.files[0]
+	ps.files = ps.files[1:]
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parsePEMChains(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var chains []chain
+	atomic.AddInt64(&numChainsRead, int64(len(groups)))
+	for _, certs := range groups {
+		ps.nextID++
+		if ps.nextID <= *initialChainID || sampledOut(ps.nextID) {
+			continue
+		}
+		certs, err := filterChain(ps.nextID, certs)
+		if err != nil {
+			logSkip(ps.nextID, err)
+			continue
+		}
+		c := chain{ID: ps.nextID, certs: certs}
+		fp := sha256.New()
+		for _, cert := range certs {
+			fp.Write(cert)
+		}
+		c.Fingerprint = fp.Sum(nil)
+		c.setEndpoint()
+		chains = append(chains, c)
+	}
+	return chains, nil
+}
+
+func parsePEMChains(data []byte) ([][][]byte, error) {
+	var chains [][][]byte
+	var current [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if !cert.IsCA {
+			if current != nil {
+				chains = append(chains, current)
+			}
+			current = [][]byte{block.Bytes}
+			continue
+		}
+		if current == nil {
+			return nil, errors.New("CA certificate found before any end-entity certificate")
+		}
+		current = append(current, block.Bytes)
+	}
+	if current != nil {
+		chains = append(chains, current)
+	}
+	return chains, nil
+}
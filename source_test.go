@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-gorp/gorp"
+)
+
+func TestReaderRanges(t *testing.T) {
+	for _, tc := range []struct {
+		from, to int64
+		readers  int
+		want     []int64
+	}{
+		{0, 10, 1, []int64{0, 10}},
+		{0, 10, 3, []int64{0, 3, 6, 10}},
+		{100, 200, 4, []int64{100, 125, 150, 175, 200}},
+		{5, 7, 4, []int64{5, 7}},
+		{0, 1 << 40, 2, []int64{0, 1 << 39, 1 << 40}},
+	} {
+		got, err := readerRanges(context.Background(), nil, tc.from, tc.to, tc.readers)
+		if err != nil {
+			t.Fatalf("readerRanges failed: %s", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readerRanges(%d, %d, %d) = %d, want %d", tc.from, tc.to, tc.readers, got, tc.want)
+		}
+	}
+}
+
+// reportRows returns the reports rows and raw certs by cert_fp that the
+// database would give getCerts for reports
+func reportRows(reports []testReport) ([]report, map[string][]byte) {
+	rows := make([]report, len(reports))
+	byFP := make(map[string][]byte)
+	for i, r := range reports {
+		rows[i] = report{CertFP: testCertFP(r.der), EndEntity: r.endEntity}
+		if !r.missing {
+			byFP[rows[i].CertFP] = r.der
+		}
+	}
+	return rows, byFP
+}
+
+// multiLeaf returns a chain's reports with a second end-entity from the same
+// intermediate reported after it, and the chain with only the first
+func multiLeaf(t *testing.T) ([]testReport, [][]byte) {
+	certs, intermediate := testChain(t)
+	other := issue(t, leafTemplate("other.example.com"), intermediate)
+	return append(leafFirst(certs), testReport{der: other.der, endEntity: true}), certs
+}
+
+func TestAssembleCertsMultiLeaf(t *testing.T) {
+	reports, certs := multiLeaf(t)
+	rows, byFP := reportRows(reports)
+	for _, tc := range []struct {
+		policy string
+		want   [][]byte
+		err    error
+	}{
+		{"skip", nil, errMultiLeaf},
+		{"error", nil, errMultiLeaf},
+		{"first", certs, nil},
+	} {
+		setValue(t, onMultiLeaf, tc.policy)
+		zeroCounters(t, &numMultiLeaf)
+		got, err := assembleCerts(rows, byFP)
+		if err != tc.err || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("-onMultiLeaf %s: assembleCerts returned %d certs and %v, want %d and %v", tc.policy, len(got), err, len(tc.want), tc.err)
+		}
+		if numMultiLeaf != 1 {
+			t.Errorf("-onMultiLeaf %s: counted %d multiple end-entity chains, want 1", tc.policy, numMultiLeaf)
+		}
+	}
+}
+
+func TestGetCertsMultiLeaf(t *testing.T) {
+	reports, certs := multiLeaf(t)
+	for _, policy := range []string{"skip", "first", "error"} {
+		setValue(t, onMultiLeaf, policy)
+		zeroCounters(t, &numMultiLeaf)
+		db := testDB(t, "sqlite", "")
+		fp := addTestChain(t, db, 1, reports)
+		chains, err := fetchCerts(context.Background(), db, []chain{{ID: 1, Fingerprint: fp}})
+		switch policy {
+		case "skip":
+			if err != nil || len(chains) != 0 {
+				t.Errorf("-onMultiLeaf skip: got %d chains and %v, want the chain skipped", len(chains), err)
+			}
+		case "first":
+			if err != nil || len(chains) != 1 || !reflect.DeepEqual(chains[0].certs, certs) {
+				t.Errorf("-onMultiLeaf first: got %d chains and %v, want the chain with the first end-entity", len(chains), err)
+			}
+		case "error":
+			if ee, ok := err.(exitError); !ok || ee.code != exitPipeline {
+				t.Errorf("-onMultiLeaf error: got %v, want the run stopped with exit code %d", err, exitPipeline)
+			}
+		}
+		if numMultiLeaf != 1 {
+			t.Errorf("-onMultiLeaf %s: counted %d multiple end-entity chains, want 1", policy, numMultiLeaf)
+		}
+	}
+}
+
+func TestDedupeCerts(t *testing.T) {
+	zeroCounters(t, &numDuplicateCerts)
+	leaf, a, b := []byte("leaf"), []byte("a"), []byte("b")
+	got := dedupeCerts([][]byte{leaf, a, b, a, leaf})
+	if want := [][]byte{leaf, a, b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dedupeCerts = %q, want %q", got, want)
+	}
+	if numDuplicateCerts != 2 {
+		t.Errorf("counted %d duplicate certs, want 2", numDuplicateCerts)
+	}
+}
+
+func TestFilterChainDuplicateIntermediate(t *testing.T) {
+	zeroCounters(t, &numDuplicateCerts)
+	certs, _ := testChain(t)
+	got, err := filterChain(1, [][]byte{certs[0], certs[1], certs[1], certs[2]})
+	if err != nil {
+		t.Fatalf("filterChain failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, certs) {
+		t.Errorf("filterChain returned %d certs, want the %d without the duplicate intermediate", len(got), len(certs))
+	}
+	if numDuplicateCerts != 1 {
+		t.Errorf("counted %d duplicate certs, want 1", numDuplicateCerts)
+	}
+}
+
+func TestFilterChainInvalidDER(t *testing.T) {
+	certs, _ := testChain(t)
+	// trailing data after the certificate is enough for Go to refuse it
+	bad := [][]byte{certs[0], append(append([]byte{}, certs[1]...), 0), certs[2]}
+	for _, validate := range []bool{false, true} {
+		zeroCounters(t, &numInvalidDER, &numUnorderable)
+		setValue(t, validateCertDER, validate)
+		got, err := filterChain(1, bad)
+		if validate {
+			if err == nil || numInvalidDER != 1 {
+				t.Errorf("filterChain with -validateDER returned %v and counted %d invalid chains, want an error and 1", err, numInvalidDER)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("filterChain failed: %s", err)
+		}
+		if !reflect.DeepEqual(got, bad) || numUnorderable != 0 {
+			t.Error("filterChain without -validateDER didn't leave the chain as it was")
+		}
+	}
+}
+
+func TestAssembleCertsDangling(t *testing.T) {
+	certs, _ := testChain(t)
+	reports := leafFirst(certs)
+	reports[1].missing = true
+	rows, byFP := reportRows(reports)
+	_, err := assembleCerts(rows, byFP)
+	if dangling, ok := err.(danglingCertError); !ok || dangling.certFP != rows[1].CertFP {
+		t.Errorf("assembleCerts with a missing cert returned %v, want a dangling cert_fp %s", err, rows[1].CertFP)
+	}
+}
+
+func TestGetCertsDangling(t *testing.T) {
+	zeroCounters(t, &numDanglingCert, &numResolved)
+	setValue(t, &progress, newWatermark())
+	db := testDB(t, "sqlite", "")
+	certs, _ := testChain(t)
+	reports := leafFirst(certs)
+	reports[1].missing = true
+	fp := addTestChain(t, db, 1, reports)
+	c := chain{ID: 1, Fingerprint: fp}
+	err := getCerts(context.Background(), db, &c)
+	if err == nil || !strings.Contains(err.Error(), testCertFP(certs[1])) || !strings.Contains(err.Error(), fmt.Sprintf("%x", fp)) {
+		t.Errorf("getCerts returned %v, want an error naming the chain_fp and the missing cert_fp", err)
+	}
+	if _, ok := err.(fetchError); ok {
+		t.Error("a dangling cert was treated as a database failure")
+	}
+	if numDanglingCert != 1 {
+		t.Errorf("counted %d dangling certs, want 1", numDanglingCert)
+	}
+	// the chain is skipped without stopping the rest of the page, and
+	// without holding the watermark for a retry that would fail the same way
+	chains, err := fetchCerts(context.Background(), db, []chain{{ID: 1, Fingerprint: fp}})
+	if err != nil || len(chains) != 0 {
+		t.Errorf("fetchCerts returned %d chains and %v, want the chain skipped", len(chains), err)
+	}
+	if progress.held != 0 {
+		t.Errorf("a dangling chain held the watermark at %d", progress.held)
+	}
+}
+
+// queryCounter is a gorp logger that counts the queries it's given
+type queryCounter int64
+
+func (qc *queryCounter) Printf(string, ...interface{}) {
+	atomic.AddInt64((*int64)(qc), 1)
+}
+
+// getCertsOneByOne is how getCerts used to load a chain, one query for the
+// reports and then another for each cert
+func getCertsOneByOne(db *gorp.DbMap, c *chain) error {
+	var reports []report
+	if _, err := db.Select(&reports, rebind(db.Dialect, tableQuery(selectReports)), c.Fingerprint); err != nil {
+		return err
+	}
+	c.certs = nil
+	for _, r := range reports {
+		var raw []byte
+		if err := db.SelectOne(&raw, rebind(db.Dialect, tableQuery("SELECT raw_cert FROM {certs} WHERE cert_fp = ?")), r.CertFP); err != nil {
+			return err
+		}
+		if r.EndEntity {
+			c.certs = append([][]byte{raw}, c.certs...)
+		} else {
+			c.certs = append(c.certs, raw)
+		}
+	}
+	return nil
+}
+
+func BenchmarkGetCerts(b *testing.B) {
+	db := testDB(b, "sqlite", "")
+	certs, _ := testChain(b)
+	fp := addTestChain(b, db, 1, leafFirst(certs))
+	ctx := context.Background()
+	for _, bc := range []struct {
+		name string
+		get  func(*chain) error
+	}{
+		{"OneByOne", func(c *chain) error { return getCertsOneByOne(db, c) }},
+		{"In", func(c *chain) error { return getCerts(ctx, db, c) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var queries queryCounter
+			db.TraceOn("", &queries)
+			defer db.TraceOff()
+			for i := 0; i < b.N; i++ {
+				c := chain{ID: 1, Fingerprint: fp}
+				if err := bc.get(&c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+func TestCheckSourceFlags(t *testing.T) {
+	for _, tc := range []struct {
+		chainFP, pemFile, pemDir, sourceLogURL, resubmitFile string
+		ok                                                   bool
+	}{
+		{ok: true},
+		{pemFile: "chains.pem", pemDir: "chains", ok: true},
+		{resubmitFile: "rejects.jsonl", ok: true},
+		{pemFile: "chains.pem", resubmitFile: "rejects.jsonl"},
+		{sourceLogURL: "https://log.example.com", resubmitFile: "rejects.jsonl"},
+		{chainFP: "00", pemDir: "chains"},
+		{chainFP: "00", resubmitFile: "rejects.jsonl"},
+	} {
+		setValue(t, chainFP, tc.chainFP)
+		setValue(t, pemFile, tc.pemFile)
+		setValue(t, pemDir, tc.pemDir)
+		setValue(t, sourceLogURL, tc.sourceLogURL)
+		setValue(t, resubmitFile, tc.resubmitFile)
+		if err := checkSourceFlags(); (err == nil) != tc.ok {
+			t.Errorf("checkSourceFlags with %+v returned %v", tc, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type getSTHResponse struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (l *ctLog) fetchSTH(c httpClient) (int64, error) {
+	sth, err := l.getSTH(c)
+	if err != nil {
+		return 0, err
+	}
+	return sth.Timestamp, nil
+}
+
+func (l *ctLog) getSTH(c httpClient) (*getSTHResponse, error) {
+	url := l.base + getSTHPath
+	req, err := newGetRequest(url)
+	if err != nil {
+		return nil, err
+	}
+	l.authorize(req)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading STH from %s: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d, body: %s", url, resp.StatusCode, body)
+	}
+	var sth getSTHResponse
+	err = json.Unmarshal(body, &sth)
+	if err != nil {
+		return nil, fmt.Errorf("malformed STH from %s: %s", url, err)
+	}
+	return &sth, nil
+}
+
+// probeLogs makes the read-only calls -dryRunProbe uses to check each log is
+// reachable, the auth token works, and TLS verifies, without posting
+// anything. The tree size and STH timestamp are printed so it's clear which
+// log (or shard) is configured. withRoots fetches get-roots too
+func probeLogs(c httpClient, logs []*ctLog, withRoots bool) error {
+	failed := 0
+	for _, l := range logs {
+		sth, err := l.getSTH(c)
+		if err != nil {
+			fmt.Fprintf(statsOut, "# [Probe of %s failed: %s]\n", l.url, err)
+			failed++
+			continue
+		}
+		ts := time.UnixMilli(sth.Timestamp).UTC()
+		fmt.Fprintf(statsOut, "# [Probe of %s: tree size %d, STH timestamp %s (%s ago)]\n", l.url, sth.TreeSize, ts.Format(time.RFC3339), time.Since(ts).Round(time.Second))
+		if !withRoots {
+			continue
+		}
+		roots, err := fetchRoots(c, []*ctLog{l})
+		if err != nil {
+			fmt.Fprintf(statsOut, "# [Probe of %s roots failed: %s]\n", l.url, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(statsOut, "# [Probe of %s: %d accepted roots]\n", l.url, len(roots.fps))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d probes failed", failed, len(logs))
+	}
+	return nil
+}
+
+// refreshSTH fetches the log's STH every interval until ctx is done, falling
+// back to local time whenever the STH can't be fetched
+func (l *ctLog) refreshSTH(ctx context.Context, c httpClient, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ts, err := l.fetchSTH(c)
+		if err != nil {
+			slog.Warn("failed to fetch STH, using local time for freshness", "log", l.url, "err", err)
+		}
+		atomic.StoreInt64(&l.sthTimestamp, ts)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// now is the log's idea of the current time, the timestamp of its latest STH
+// if we have one, so SCT freshness isn't thrown off by clock skew
+func (l *ctLog) now() time.Time {
+	if ts := atomic.LoadInt64(&l.sthTimestamp); ts != 0 {
+		return time.UnixMilli(ts)
+	}
+	return time.Now()
+}
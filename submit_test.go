@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmit(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	setValue(t, &progress, newWatermark())
+	zeroCounters(t, &numSubmitted, &numNewSubmitted, &numResolved)
+	_, precert := precerts(t)
+	precertSub := &pendingChain{chain: precert, remaining: 1}
+	precertSub.ID = 2
+	log := ml.log()
+	subs := []*pendingChain{testSubmission(t, 1), precertSub}
+	for _, sub := range subs {
+		progress.add(sub.ID)
+		ctr, err := submit(context.Background(), ml.Client(), log, sub)
+		if err != nil {
+			t.Fatalf("chain %d: submit failed: %s", sub.ID, err)
+		}
+		if ctr == nil || ctr.Timestamp == 0 {
+			t.Fatalf("chain %d: submit returned SCT %+v", sub.ID, ctr)
+		}
+		if sub.scts != 1 {
+			t.Errorf("chain %d: %d SCTs counted, want 1", sub.ID, sub.scts)
+		}
+	}
+	if len(ml.chains) != 2 || !reflect.DeepEqual(ml.chains[0], subs[0].certs) || !reflect.DeepEqual(ml.chains[1], subs[1].certs) {
+		t.Errorf("log didn't get the submitted chains")
+	}
+	if log.numSubmitted != 2 || log.numNewSubmitted != 2 {
+		t.Errorf("log counted %d submitted and %d new, want 2 and 2", log.numSubmitted, log.numNewSubmitted)
+	}
+	if numSubmitted != 2 || numNewSubmitted != 2 || numResolved != 2 {
+		t.Errorf("%d chains submitted, %d new and %d resolved, want 2, 2 and 2", numSubmitted, numNewSubmitted, numResolved)
+	}
+	if got := progress.get(); got != 2 {
+		t.Errorf("watermark at %d, want 2", got)
+	}
+}
+
+func TestSubmitErrors(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	zeroCounters(t, &numSubmitted, &numResolved)
+	for _, tc := range []struct {
+		name      string
+		response  mockResponse
+		retryable bool
+		after     time.Duration
+		rejected  bool
+	}{
+		{name: "internal error", response: mockResponse{status: http.StatusInternalServerError, body: "oops"}, retryable: true},
+		{name: "unavailable", response: mockResponse{status: http.StatusServiceUnavailable}, retryable: true},
+		{name: "rate limited", response: mockResponse{status: http.StatusTooManyRequests, retryAfter: "7"}, retryable: true, after: 7 * time.Second},
+		{name: "bad request", response: mockResponse{status: http.StatusBadRequest, body: "unknown root"}, rejected: true},
+		{name: "HTML error page", response: mockResponse{status: http.StatusOK, body: "<html><body>502 Bad Gateway</body></html>"}},
+		{name: "empty body", response: mockResponse{status: http.StatusOK}},
+		{name: "empty object", response: mockResponse{status: http.StatusOK, body: "{}"}},
+		{name: "zero timestamp", response: mockResponse{status: http.StatusOK, body: `{"sct_version":0,"id":"aWQ=","timestamp":0,"extensions":"","signature":"c2ln"}`}},
+		{name: "truncated", response: mockResponse{status: http.StatusOK, body: `{"sct_version":0,"id":"aWQ=","times`}},
+	} {
+		log := ml.log()
+		sub := testSubmission(t, 1)
+		ml.respond(tc.response)
+		ctr, err := submit(context.Background(), ml.Client(), log, sub)
+		if err == nil {
+			t.Errorf("%s: submit succeeded with SCT %+v", tc.name, ctr)
+			continue
+		}
+		if isRetryable(err) != tc.retryable {
+			t.Errorf("%s: isRetryable(%q) = %t, want %t", tc.name, err, !tc.retryable, tc.retryable)
+		}
+		if re, ok := err.(retryableError); ok && re.after != tc.after {
+			t.Errorf("%s: retry after %s, want %s", tc.name, re.after, tc.after)
+		}
+		re, rejected := err.(rejectedError)
+		if rejected != tc.rejected {
+			t.Errorf("%s: rejected = %t, want %t", tc.name, rejected, tc.rejected)
+		}
+		if rejected && (re.status != tc.response.status || string(re.body) != tc.response.body) {
+			t.Errorf("%s: rejected with status %d and body %q, want %d and %q", tc.name, re.status, re.body, tc.response.status, tc.response.body)
+		}
+		if log.numSubmitted != 0 || sub.scts != 0 || sub.remaining != 1 {
+			t.Errorf("%s: failed submission was counted", tc.name)
+		}
+	}
+	if numSubmitted != 0 || numResolved != 0 {
+		t.Errorf("%d chains submitted and %d resolved after only failures", numSubmitted, numResolved)
+	}
+}
+
+func TestSubmitBadSCT(t *testing.T) {
+	ml := newMockLog(t)
+	// the log's SCTs are checked against some other log's key
+	setValue(t, &logKeys, testKeyring(t, newTestKey(t)))
+	zeroCounters(t, &numBadSCT, &numSubmitted)
+	log := ml.log()
+	if _, err := submit(context.Background(), ml.Client(), log, testSubmission(t, 1)); err == nil {
+		t.Fatal("submit accepted an SCT that doesn't verify")
+	}
+	if numBadSCT != 1 || log.numSubmitted != 0 || numSubmitted != 0 {
+		t.Errorf("counted %d bad SCTs and %d submissions, want 1 and 0", numBadSCT, log.numSubmitted)
+	}
+}
+
+func TestSubmitWithRetry(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	setValue(t, maxRetries, 2)
+	zeroCounters(t, &numSubmitted, &numResolved)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name      string
+		responses []mockResponse
+		ok        bool
+		requests  int
+		// min and max bound how long the retries take
+		min, max time.Duration
+	}{
+		{
+			name:      "recovers",
+			responses: []mockResponse{{status: http.StatusInternalServerError}, {status: http.StatusServiceUnavailable}},
+			ok:        true,
+			requests:  3,
+			max:       5 * time.Second,
+		},
+		{
+			name:      "gives up",
+			responses: []mockResponse{{status: http.StatusBadGateway}, {status: http.StatusBadGateway}, {status: http.StatusBadGateway}},
+			requests:  3,
+			max:       5 * time.Second,
+		},
+		{
+			name:      "Retry-After",
+			responses: []mockResponse{{status: http.StatusTooManyRequests, retryAfter: "1"}},
+			ok:        true,
+			requests:  2,
+			min:       time.Second,
+			max:       5 * time.Second,
+		},
+		{
+			name:      "Retry-After clamped",
+			responses: []mockResponse{{status: http.StatusTooManyRequests, retryAfter: "3600"}},
+			ok:        true,
+			requests:  2,
+			max:       5 * time.Second,
+		},
+		{
+			name:      "rejected",
+			responses: []mockResponse{{status: http.StatusBadRequest}},
+			requests:  1,
+			max:       time.Second,
+		},
+	} {
+		setValue(t, maxRetryAfter, 10*time.Millisecond)
+		if tc.min > 0 {
+			*maxRetryAfter = maxBackoff
+		}
+		ml.respond(tc.responses...)
+		before := ml.requestCount()
+		started := time.Now()
+		ctr, err := submitWithRetry(ctx, ml.Client(), ml.log(), testSubmission(t, 1))
+		took := time.Since(started)
+		if tc.ok && (err != nil || ctr == nil) {
+			t.Errorf("%s: submitWithRetry failed: %v", tc.name, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%s: submitWithRetry succeeded", tc.name)
+		}
+		if n := ml.requestCount() - before; n != tc.requests {
+			t.Errorf("%s: %d requests sent, want %d", tc.name, n, tc.requests)
+		}
+		if took < tc.min || took > tc.max {
+			t.Errorf("%s: took %s, want between %s and %s", tc.name, took, tc.min, tc.max)
+		}
+	}
+}
+
+func TestSubmitChains(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	setValue(t, &progress, newWatermark())
+	// a single worker takes the chains in order, so the responses line up
+	setValue(t, workers, 1)
+	setValue(t, maxRetries, 0)
+	zeroCounters(t, &numSubmitted, &numNewSubmitted, &numRejected, &numFailed, &numSubmitFailed, &numResolved, &lastSubmittedChain)
+	ml.respond(
+		mockResponse{},
+		mockResponse{status: http.StatusServiceUnavailable},
+		mockResponse{},
+		mockResponse{status: http.StatusBadRequest},
+	)
+	submissions := make(chan chain, 4)
+	for id := int64(1); id <= 4; id++ {
+		progress.add(id)
+		submissions <- testSubmission(t, id).chain
+	}
+	close(submissions)
+	log := ml.log()
+	if err := submitChains(context.Background(), ml.Client(), submissions, []*ctLog{log}); err != nil {
+		t.Fatalf("submitChains failed: %s", err)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want int64
+	}{
+		{"submitted", numSubmitted, 2},
+		{"new", numNewSubmitted, 2},
+		{"rejected", numRejected, 1},
+		{"failed", numFailed, 1},
+		{"submit failures", numSubmitFailed, 1},
+		{"resolved", numResolved, 4},
+		{"log submitted", log.numSubmitted, 2},
+		{"log rejected", log.numRejected, 1},
+		{"log failed", log.numFailed, 1},
+		{"last submitted chain", lastSubmittedChain, 3},
+		// chain 2 failed, so the next run resumes from it
+		{"watermark", progress.get(), 1},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %d, want %d", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestSubmitTimeout(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, httpTimeout, 50*time.Millisecond)
+	c, err := newLogClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ml.respond(mockResponse{delay: 500 * time.Millisecond})
+	started := time.Now()
+	_, err = submit(context.Background(), c, ml.log(), testSubmission(t, 1))
+	if err == nil {
+		t.Fatal("submit succeeded against a log slower than -httpTimeout")
+	}
+	if !isRetryable(err) {
+		t.Errorf("timeout %q isn't retryable", err)
+	}
+	if took := time.Since(started); took > 400*time.Millisecond {
+		t.Errorf("submit took %s, the timeout is 50ms", took)
+	}
+}
+
+func TestSubmitShutdownWaitingForSlot(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &requestSlots, newSemaphore(1))
+	// the only slot is held by some other request
+	requestSlots.acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := submit(ctx, ml.Client(), ml.log(), testSubmission(t, 1)); err != context.Canceled {
+		t.Errorf("submit waiting for a slot after shutdown returned %v, want %s", err, context.Canceled)
+	}
+	if n := ml.requestCount(); n != 0 {
+		t.Errorf("log got %d requests, want none", n)
+	}
+}
+
+func TestIsFresh(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	for _, tc := range []struct {
+		ts   int64
+		want bool
+	}{
+		{1700000000000, true},
+		{1700000000000 - 59*60*1000, true},
+		{1700000000000 - 60*60*1000, false},
+		{1700000000000 - 2*60*60*1000, false},
+	} {
+		if got := isFresh(tc.ts, now, time.Hour); got != tc.want {
+			t.Errorf("isFresh(%d, %d, 1h) = %t, want %t", tc.ts, now.UnixMilli(), got, tc.want)
+		}
+	}
+}
+
+func TestSubmitFreshCounter(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	setValue(t, freshWindow, 10*time.Minute)
+	zeroCounters(t, &numSubmitted, &numNewSubmitted, &numResolved)
+	now := time.Now()
+	ml.respond(
+		mockResponse{timestamp: now.Add(-time.Minute).UnixMilli()},
+		mockResponse{timestamp: now.Add(-time.Hour).UnixMilli()},
+		mockResponse{timestamp: now.Add(-9 * time.Minute).UnixMilli()},
+	)
+	log := ml.log()
+	for id := int64(1); id <= 3; id++ {
+		if _, err := submit(context.Background(), ml.Client(), log, testSubmission(t, id)); err != nil {
+			t.Fatalf("submit failed: %s", err)
+		}
+	}
+	if log.numSubmitted != 3 || log.numNewSubmitted != 2 || numNewSubmitted != 2 {
+		t.Errorf("%d of %d SCTs counted as new (%d overall), want 2", log.numNewSubmitted, log.numSubmitted, numNewSubmitted)
+	}
+}
+
+func TestLastSubmittedChain(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	setValue(t, &progress, newWatermark())
+	setValue(t, workers, 1)
+	setValue(t, maxRetries, 0)
+	zeroCounters(t, &numSubmitted, &numFailed, &numSubmitFailed, &numResolved, &lastSubmittedChain)
+	// everything after the first chain fails
+	ml.respond(mockResponse{}, mockResponse{status: http.StatusInternalServerError}, mockResponse{status: http.StatusInternalServerError})
+	submissions := make(chan chain, 3)
+	for id := int64(1); id <= 3; id++ {
+		progress.add(id)
+		submissions <- testSubmission(t, id).chain
+	}
+	close(submissions)
+	if err := submitChains(context.Background(), ml.Client(), submissions, []*ctLog{ml.log()}); err != nil {
+		t.Fatalf("submitChains failed: %s", err)
+	}
+	if lastSubmittedChain != 1 {
+		t.Errorf("last submitted chain is %d, want 1", lastSubmittedChain)
+	}
+	if numSubmitted != 1 || numFailed != 2 {
+		t.Errorf("%d chains submitted and %d failed, want 1 and 2", numSubmitted, numFailed)
+	}
+}
+
+func TestSubmitReusesConnections(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	zeroCounters(t, &numSubmitted, &numResolved)
+	ml.respond(
+		mockResponse{},
+		mockResponse{status: http.StatusInternalServerError, body: strings.Repeat("x", 64*1024)},
+		mockResponse{status: http.StatusBadRequest, body: "bad chain"},
+		mockResponse{status: http.StatusOK, body: "<html>not an SCT</html>"},
+		mockResponse{},
+	)
+	log := ml.log()
+	for id := int64(1); id <= 5; id++ {
+		submit(context.Background(), ml.Client(), log, testSubmission(t, id))
+	}
+	if n := ml.requestCount(); n != 5 {
+		t.Fatalf("%d requests sent, want 5", n)
+	}
+	if n := ml.connCount(); n != 1 {
+		t.Errorf("5 sequential submissions opened %d connections, want 1", n)
+	}
+}
+
+func TestSubmitMediaTypes(t *testing.T) {
+	ml := newMockLog(t)
+	setValue(t, &logKeys, ml.keyring())
+	zeroCounters(t, &numSubmitted, &numResolved)
+	log := ml.log()
+	if _, err := submit(context.Background(), ml.Client(), log, testSubmission(t, 1)); err != nil {
+		t.Fatalf("submit failed: %s", err)
+	}
+	if ct := ml.lastHeader().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("sent Content-Type %q, want application/json", ct)
+	}
+	if accept := ml.lastHeader().Get("Accept"); accept != "application/json" {
+		t.Errorf("sent Accept %q, want application/json", accept)
+	}
+	if log.warnedMediaType != 0 {
+		t.Error("warned about media types after a successful submission")
+	}
+	for _, status := range []int{http.StatusUnsupportedMediaType, http.StatusNotAcceptable} {
+		log := ml.log()
+		ml.respond(mockResponse{status: status})
+		_, err := submit(context.Background(), ml.Client(), log, testSubmission(t, 1))
+		if _, ok := err.(rejectedError); !ok {
+			t.Errorf("status %d: got %v, want a rejection", status, err)
+		}
+		if log.warnedMediaType != 1 {
+			t.Errorf("status %d: media types weren't diagnosed", status)
+		}
+	}
+}
+
+// BenchmarkTransport submits from as many goroutines as -workers with the
+// tuned transport and with the default one, which keeps only 2 idle
+// connections per host so most requests beyond that open a new one
+func BenchmarkTransport(b *testing.B) {
+	ml := newMockLog(b)
+	setValue(b, &logKeys, nil)
+	setValue(b, &progress, newWatermark())
+	parallelism := 8
+	setValue(b, workers, parallelism*runtime.GOMAXPROCS(0))
+	zeroCounters(b, &numSubmitted, &numNewSubmitted, &numResolved, &lastSubmittedChain)
+	tuned, err := newLogClient()
+	if err != nil {
+		b.Fatal(err)
+	}
+	sub := testSubmission(b, 1)
+	for _, bc := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{"Default", &http.Client{Transport: &http.Transport{}}},
+		{"Tuned", tuned},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			log := ml.log()
+			conns := ml.connCount()
+			b.SetParallelism(parallelism)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := submit(context.Background(), bc.client, log, sub); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(ml.connCount()-conns), "conns")
+			bc.client.CloseIdleConnections()
+		})
+	}
+}
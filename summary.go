@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// runSummary is printed, and optionally written to -summaryFile, at the end
+// of every run, including interrupted ones
+type runSummary struct {
+	Version string `json:"version"`
+	// Chains is the unique chains read from the source, Queued the ones
+	// left to submit once the source had skipped what it could
+	Chains             int64   `json:"chains"`
+	Queued             int64   `json:"queued"`
+	Submitted          int64   `json:"submitted"`
+	New                int64   `json:"new"`
+	Rejected           int64   `json:"rejected"`
+	Failed             int64   `json:"failed"`
+	ElapsedSeconds     float64 `json:"elapsed_seconds"`
+	SubmissionRate     float64 `json:"submission_rate"`
+	LastSubmittedChain int64   `json:"last_submitted_chain_id"`
+	ResolvedUpTo       int64   `json:"resolved_up_to_chain_id"`
+	// Skipped counts the skipped chains by reason, the in-flight and already
+	// submitted ones are counted once per log
+	Skipped map[string]int64 `json:"skipped,omitempty"`
+	// StatusCodes counts the add-chain responses by HTTP status
+	StatusCodes map[int]int64 `json:"status_codes,omitempty"`
+}
+
+func summarize(started time.Time) runSummary {
+	elapsed := time.Since(started)
+	rs := runSummary{
+		Version:            version,
+		Chains:             atomic.LoadInt64(&numChainsRead),
+		Queued:             atomic.LoadInt64(&numEnqueued),
+		Submitted:          atomic.LoadInt64(&numSubmitted),
+		New:                atomic.LoadInt64(&numNewSubmitted),
+		Rejected:           atomic.LoadInt64(&numRejected),
+		Failed:             atomic.LoadInt64(&numFailed),
+		ElapsedSeconds:     elapsed.Seconds(),
+		LastSubmittedChain: atomic.LoadInt64(&lastSubmittedChain),
+		ResolvedUpTo:       progress.get(),
+		StatusCodes:        statusBreakdown(),
+	}
+	for _, c := range skipCounters {
+		if v := atomic.LoadInt64(c.value); v != 0 {
+			if rs.Skipped == nil {
+				rs.Skipped = make(map[string]int64)
+			}
+			rs.Skipped[c.name] = v
+		}
+	}
+	rs.SubmissionRate = submissionRate(rs.Submitted, elapsed)
+	return rs
+}
+
+func (rs runSummary) print(w io.Writer) {
+	fmt.Fprintf(
+		w,
+		"# [Summary (dso-to-ct %s): %d chains, %d queued, %d submitted (%d new), %d rejected, %d failed, %s elapsed, %3.2f/s]\n",
+		rs.Version,
+		rs.Chains,
+		rs.Queued,
+		rs.Submitted,
+		rs.New,
+		rs.Rejected,
+		rs.Failed,
+		time.Duration(rs.ElapsedSeconds*float64(time.Second)).Round(time.Second),
+		rs.SubmissionRate,
+	)
+	if len(rs.Skipped) > 0 {
+		reasons := make([]string, 0, len(rs.Skipped))
+		for reason := range rs.Skipped {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for i, reason := range reasons {
+			reasons[i] = fmt.Sprintf("%s: %d", reason, rs.Skipped[reason])
+		}
+		fmt.Fprintf(w, "# [Skipped: %s]\n", strings.Join(reasons, ", "))
+	}
+	if len(rs.StatusCodes) == 0 {
+		return
+	}
+	codes := make([]int, 0, len(rs.StatusCodes))
+	for code := range rs.StatusCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	breakdown := make([]string, len(codes))
+	for i, code := range codes {
+		breakdown[i] = fmt.Sprintf("%d: %d", code, rs.StatusCodes[code])
+	}
+	fmt.Fprintf(w, "# [Responses by status: %s]\n", strings.Join(breakdown, ", "))
+}
+
+func writeSummary(path string, rs runSummary) error {
+	data, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
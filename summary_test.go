@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	zeroCounters(t, append(statCounterValues(skipCounters), &numChainsRead, &numEnqueued, &numSubmitted, &numRejected, &numFailed)...)
+	numChainsRead, numEnqueued, numSubmitted, numExpiredSkipped, numDedupSkipped = 10, 7, 5, 3, 2
+
+	rs := summarize(time.Now().Add(-time.Minute))
+	if rs.Chains != 10 || rs.Queued != 7 || rs.Submitted != 5 {
+		t.Errorf("got %d chains, %d queued, %d submitted, want 10, 7, 5", rs.Chains, rs.Queued, rs.Submitted)
+	}
+	if rs.Skipped["expired"] != 3 || rs.Skipped["already submitted"] != 2 || len(rs.Skipped) != 2 {
+		t.Errorf("got skipped %v, want expired: 3 and already submitted: 2", rs.Skipped)
+	}
+	var b bytes.Buffer
+	rs.print(&b)
+	if !strings.Contains(b.String(), "# [Skipped: already submitted: 2, expired: 3]") {
+		t.Errorf("summary doesn't list the skip reasons:\n%s", b.String())
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := writeSummary(path, rs); err != nil {
+		t.Fatalf("writeSummary failed: %s", err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written runSummary
+	if err := json.Unmarshal(contents, &written); err != nil {
+		t.Fatalf("malformed summary file: %s", err)
+	}
+	if written.Chains != 10 || written.Skipped["expired"] != 3 {
+		t.Errorf("summary file doesn't match, got %+v", written)
+	}
+}
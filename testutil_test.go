@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testIssuer is a CA certificate and its key, for issuing test chains
+type testIssuer struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+func newTestKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// issue signs tmpl with the issuer, or self-signs it if issuer is nil
+func issue(t testing.TB, tmpl *x509.Certificate, issuer *testIssuer) *testIssuer {
+	t.Helper()
+	return issueKey(t, tmpl, issuer, newTestKey(t))
+}
+
+// issueKey is issue for a given subject key, unset serials and validity
+// periods are filled in on tmpl so it can be issued again identically
+func issueKey(t testing.TB, tmpl *x509.Certificate, issuer *testIssuer, key *ecdsa.PrivateKey) *testIssuer {
+	t.Helper()
+	if tmpl.SerialNumber == nil {
+		testSerial++
+		tmpl.SerialNumber = big.NewInt(testSerial)
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+	}
+	parent, signer := tmpl, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{cert: cert, der: der, key: key}
+}
+
+func caTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+}
+
+func leafTemplate(name string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// testChain issues a root, an intermediate and a leaf, and returns them leaf
+// first along with the intermediate
+func testChain(t testing.TB) ([][]byte, *testIssuer) {
+	t.Helper()
+	root := issue(t, caTemplate("test root"), nil)
+	intermediate := issue(t, caTemplate("test intermediate"), root)
+	leaf := issue(t, leafTemplate("leaf.example.com"), intermediate)
+	return [][]byte{leaf.der, intermediate.der, root.der}, intermediate
+}
+
+// zeroCounters zeroes the given global counters for the test, and restores
+// them once it's done
+func zeroCounters(t testing.TB, counters ...*int64) {
+	saved := make([]int64, len(counters))
+	for i, c := range counters {
+		saved[i], *c = *c, 0
+	}
+	t.Cleanup(func() {
+		for i, c := range counters {
+			*c = saved[i]
+		}
+	})
+}
+
+// statCounterValues returns pointers to the values of counters
+func statCounterValues(counters []statCounter) []*int64 {
+	values := make([]*int64, len(counters))
+	for i, c := range counters {
+		values[i] = c.value
+	}
+	return values
+}
+
+// setValue sets *p to v for the test, and restores it once it's done
+func setValue[T any](t testing.TB, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// testSubmission returns a freshly issued chain, ready to submit to one log
+func testSubmission(t testing.TB, id int64) *pendingChain {
+	t.Helper()
+	certs, _ := testChain(t)
+	fp := sha256.Sum256(certs[0])
+	c := chain{ID: id, Fingerprint: fp[:], certs: certs}
+	c.setEndpoint()
+	return &pendingChain{chain: c, remaining: 1}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestPhases is only observed with -trace and only exported when
+// -metricsAddr is set
+var requestPhases = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "dso_to_ct_request_phase_seconds",
+		Help:    "Time spent in each phase of add-chain requests, with -trace.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"log", "phase"},
+)
+
+// requestTrace collects the phase timings of a single request. Phases that
+// didn't happen, e.g. DNS and TLS on a reused connection, stay zero
+type requestTrace struct {
+	start                         time.Time
+	dnsStart, connStart, tlsStart time.Time
+	dns, connect, tls, ttfb       time.Duration
+	reused                        bool
+}
+
+func (rt *requestTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.reused = info.Reused
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			rt.dns = time.Since(rt.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			rt.connStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			rt.connect = time.Since(rt.connStart)
+		},
+		TLSHandshakeStart: func() {
+			rt.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			rt.tls = time.Since(rt.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			rt.ttfb = time.Since(rt.start)
+		},
+	}
+}
+
+// sendRequest sends req with c, timing its phases when -trace is set
+func sendRequest(c httpClient, l *ctLog, req *http.Request) (*http.Response, error) {
+	if !*traceRequests {
+		return c.Do(req)
+	}
+	rt := &requestTrace{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), rt.clientTrace()))
+	resp, err := c.Do(req)
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{{"dns", rt.dns}, {"connect", rt.connect}, {"tls", rt.tls}, {"first_byte", rt.ttfb}}
+	for _, p := range phases {
+		if p.d > 0 {
+			requestPhases.WithLabelValues(l.url, p.name).Observe(p.d.Seconds())
+		}
+	}
+	slog.Debug("request trace", "log", l.url, "reused_conn", rt.reused, "dns", rt.dns, "connect", rt.connect, "tls", rt.tls, "first_byte", rt.ttfb, "err", err)
+	return resp, err
+}